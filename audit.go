@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+)
+
+// auditIgnoredFields change on every write and would only add noise.
+var auditIgnoredFields = map[string]bool{"updated_at": true}
+
+type (
+	FieldChange struct {
+		Old interface{} `json:"old"`
+		New interface{} `json:"new"`
+	}
+
+	// AuditChanges maps each changed JSON field to its old and new value and is
+	// stored as jsonb.
+	AuditChanges map[string]FieldChange
+)
+
+func (a AuditChanges) Value() (driver.Value, error) {
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+func (a *AuditChanges) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	case nil:
+		*a = nil
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into AuditChanges", src)
+}
+
+// userFields flattens user into its JSON fields; a nil user has none.
+func userFields(user *Users) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if user == nil {
+		return fields, nil
+	}
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+// diffUsers lists the fields that differ between before and after, either of
+// which may be nil. Password hashes are never copied into the log.
+func diffUsers(before, after *Users) (AuditChanges, error) {
+	old, err := userFields(before)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := userFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := AuditChanges{}
+	for _, fields := range []map[string]interface{}{old, updated} {
+		for field := range fields {
+			if _, done := changes[field]; done || auditIgnoredFields[field] {
+				continue
+			}
+			if fmt.Sprint(old[field]) != fmt.Sprint(updated[field]) {
+				changes[field] = FieldChange{Old: old[field], New: updated[field]}
+			}
+		}
+	}
+	var oldPassword, newPassword string
+	if before != nil {
+		oldPassword = before.Password
+	}
+	if after != nil {
+		newPassword = after.Password
+	}
+	if oldPassword != newPassword {
+		changes["password"] = FieldChange{Old: "[redacted]", New: "[redacted]"}
+	}
+	return changes, nil
+}
+
+// recordAudit logs action on the user, attributed to the caller's token.
+// before is nil for creations and after is nil for deletions.
+func recordAudit(c echo.Context, tx UserRepository, action string, before, after *Users) error {
+	changes, err := diffUsers(before, after)
+	if err != nil {
+		return err
+	}
+	entry := &UserAudit{Action: action, Changes: changes}
+	if after != nil {
+		entry.UserID = after.UserID
+	} else {
+		entry.UserID = before.UserID
+	}
+	if actor, ok := c.Get("user_id").(int); ok {
+		entry.ActorID = &actor
+	}
+	return tx.CreateAudit(entry)
+}
+
+// @Summary Get a user's change history
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=[]UserAudit}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/audit [get]
+func (h *UserHandler) Audit(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid user id")
+	}
+	res, err := h.users(c).FindAudits(id)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, res, nil)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffUsers(t *testing.T) {
+	before := &Users{UserID: 1, Username: "alice", Password: "old-hash", UpdatedAt: time.Now()}
+	after := *before
+	after.FirstName = "Alice"
+	after.Password = "new-hash"
+	after.UpdatedAt = before.UpdatedAt.Add(time.Minute)
+
+	changes, err := diffUsers(before, &after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Errorf("changes = %v, want first_name and password only", changes)
+	}
+	if c := changes["first_name"]; c.Old != "" || c.New != "Alice" {
+		t.Errorf("first_name change = %+v, want \"\" to Alice", c)
+	}
+	if c := changes["password"]; c.Old != "[redacted]" || c.New != "[redacted]" {
+		t.Errorf("password change = %+v, want it redacted", c)
+	}
+
+	created, err := diffUsers(nil, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := created["username"]; c.Old != nil || c.New != "alice" {
+		t.Errorf("username on create = %+v, want nil to alice", c)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashPassword returns the bcrypt hash of a new plaintext password. Every path
+// that sets a password hashes it itself before the user is saved.
+func hashPassword(password string, cost int) (string, error) {
+	crypted, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(crypted), nil
+}
+
+// invalidCredentials is the login failure message for both unknown usernames
+// and wrong passwords.
+const invalidCredentials = "invalid username or password"
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// dummyPasswordHash returns a bcrypt hash at cost for login to compare
+// against when the user does not exist.
+func dummyPasswordHash(cost int) []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+	})
+	return dummyHash
+}
+
+// randomToken returns n random bytes encoded as hex.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of token, for storing secrets that are only
+// ever looked up, never read back.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateToken issues an access token for u, signed with secret and valid
+// for ttl.
+func generateToken(u Users, secret string, ttl time.Duration) (string, error) {
+	claims := JwtClaims{
+		UserID:   u.UserID,
+		Username: u.Username,
+		Role:     u.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secret))
+}
+
+// newJWTAuth returns the jwtAuth middleware, which accepts access tokens from
+// generateToken signed with secret.
+func newJWTAuth(secret string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if !strings.HasPrefix(auth, "Bearer ") {
+				return respondError(c, http.StatusUnauthorized, "missing or malformed token")
+			}
+			var claims JwtClaims
+			token, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), &claims, func(t *jwt.Token) (interface{}, error) {
+				if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+					return nil, errors.New("unexpected signing method")
+				}
+				return []byte(secret), nil
+			})
+			if err != nil || !token.Valid {
+				return respondError(c, http.StatusUnauthorized, "invalid or expired token")
+			}
+			c.Set("user_id", claims.UserID)
+			c.Set("role", claims.Role)
+			return next(c)
+		}
+	}
+}
+
+// currentUserID returns the id jwtAuth stored for the authenticated user.
+func currentUserID(c echo.Context) string {
+	id, _ := c.Get("user_id").(int)
+	return strconv.Itoa(id)
+}
+
+// RequireSelfOrAdmin lets through admins and the user named by the :id path
+// parameter, rejecting everyone else. It must run after jwtAuth.
+func RequireSelfOrAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		uid, _ := c.Get("user_id").(int)
+		if r, _ := c.Get("role").(string); r != roleAdmin && (err != nil || id != uid) {
+			return respondError(c, http.StatusForbidden, "insufficient permissions")
+		}
+		return next(c)
+	}
+}
+
+// RequireRole rejects requests whose token does not carry the given role. It
+// must run after jwtAuth.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if r, _ := c.Get("role").(string); r != role {
+				return respondError(c, http.StatusForbidden, "insufficient permissions")
+			}
+			return next(c)
+		}
+	}
+}
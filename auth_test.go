@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGenerateToken(t *testing.T) {
+	signed, err := generateToken(Users{UserID: 7, Username: "alice", Role: roleAdmin}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims JwtClaims
+	_, err = jwt.ParseWithClaims(signed, &claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(testJWTSecret), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.Username != "alice" || claims.Role != roleAdmin {
+		t.Errorf("claims = %+v, want user 7 alice as admin", claims)
+	}
+	if until := time.Until(claims.ExpiresAt.Time); until <= 0 || until > time.Hour {
+		t.Errorf("token expires in %v, want within the hour", until)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusOK) }, newJWTAuth(testJWTSecret))
+	token := func(secret string, ttl time.Duration) string {
+		signed, err := generateToken(Users{UserID: 1, Role: roleUser}, secret, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + signed
+	}
+	for _, tc := range []struct {
+		name, auth string
+		want       int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"not bearer", "Basic dXNlcjpwYXNz", http.StatusUnauthorized},
+		{"wrong secret", token("other-secret", time.Hour), http.StatusUnauthorized},
+		{"expired", token(testJWTSecret, -time.Minute), http.StatusUnauthorized},
+		{"valid", token(testJWTSecret, time.Hour), http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, tc.auth)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestHashPasswordCost(t *testing.T) {
+	t.Setenv("BCRYPT_COST", "5")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashPassword(testPassword, cfg.BcryptCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != 5 {
+		t.Errorf("bcrypt.Cost() = %d, %v; want 5", cost, err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(testPassword)) != nil {
+		t.Error("hash does not match the password")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	const abc = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := hashToken("abc"); got != abc {
+		t.Errorf("hashToken(%q) = %s, want %s", "abc", got, abc)
+	}
+	if hashToken("abc") == hashToken("abd") {
+		t.Error("different tokens hash alike")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const avatarURLPrefix = "/avatars"
+
+var avatarExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// @Summary Upload a user's avatar
+// @Tags users
+// @Accept multipart/form-data
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param avatar formData file true "JPEG or PNG image, at most 2MB"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/avatar [post]
+func (h *UserHandler) UploadAvatar(c echo.Context) error {
+	file, err := c.FormFile("avatar")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, "avatar is required")
+	}
+	if file.Size > maxAvatarBytes {
+		return respondError(c, http.StatusRequestEntityTooLarge, "avatar must be at most 2MB")
+	}
+	src, err := file.Open()
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	defer src.Close()
+
+	// Trust the bytes rather than the client-supplied Content-Type.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return respondError(c, http.StatusBadRequest, "avatar is empty")
+	}
+	ext, ok := avatarExtensions[http.DetectContentType(head[:n])]
+	if !ok {
+		return respondError(c, http.StatusUnsupportedMediaType, "avatar must be a JPEG or PNG image")
+	}
+
+	user, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+
+	name, err := randomToken(avatarNameBytes)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	name += ext
+	if err := os.MkdirAll(h.cfg.AvatarDir, 0o755); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	path := filepath.Join(h.cfg.AvatarDir, name)
+	dst, err := os.Create(path)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(head[:n]), src))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+
+	previous := user.AvatarURL
+	url := avatarURLPrefix + "/" + name
+	if err := h.users(c).SetAvatar(user, &url); err != nil {
+		os.Remove(path)
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	h.removeAvatarFile(previous)
+	return respondOK(c, http.StatusOK, user, nil)
+}
+
+// @Summary Remove a user's avatar
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/avatar [delete]
+func (h *UserHandler) DeleteAvatar(c echo.Context) error {
+	user, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.AvatarURL == nil {
+		return respondError(c, http.StatusNotFound, "user has no avatar")
+	}
+	previous := user.AvatarURL
+	if err := h.users(c).SetAvatar(user, nil); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	h.removeAvatarFile(previous)
+	return respondOK(c, http.StatusOK, user, nil)
+}
+
+// removeAvatarFile deletes the stored file behind url, if any. Failures only
+// leave an orphaned file behind, so they are ignored.
+func (h *UserHandler) removeAvatarFile(url *string) {
+	if url == nil || !strings.HasPrefix(*url, avatarURLPrefix+"/") {
+		return
+	}
+	os.Remove(filepath.Join(h.cfg.AvatarDir, filepath.Base(*url)))
+}
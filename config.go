@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/gommon/bytes"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings read from the environment at startup. Only
+// LOG_LEVEL and LOG_FORMAT are read before it, by newLogger, so that
+// configuration errors can be logged.
+type Config struct {
+	DatabaseDSN          string
+	DBConnectRetries     int
+	DBConnectBackoff     time.Duration
+	DBMaxOpenConns       int
+	DBMaxIdleConns       int
+	DBConnMaxLifetime    time.Duration
+	DBLogLevel           string
+	DBSlowQueryThreshold time.Duration
+	RunMigrations        bool
+
+	Addr            string
+	AppEnv          string
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSRedirectAddr string
+	RequestTimeout  time.Duration
+	BodyLimit       string
+	ImportBodyLimit string
+	GzipLevel       int
+	UserCountPublic bool
+	DefaultPageSize int
+	MaxPageSize     int
+	AvatarDir       string
+	AppBaseURL      string
+
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+
+	SMTPHost        string
+	SMTPPort        string
+	SMTPUsername    string
+	SMTPPassword    string
+	SMTPFrom        string
+	MailTemplateDir string
+
+	JWTSecret           string
+	AccessTokenTTL      time.Duration
+	RefreshTokenTTL     time.Duration
+	PasswordResetTTL    time.Duration
+	PhoneOTPTTL         time.Duration
+	IdempotencyKeyTTL   time.Duration
+	PasswordHistorySize int
+	BcryptCost          int
+	MFAEncryptionKey    string
+
+	LoginRateLimit    int
+	LoginRateWindow   time.Duration
+	ExistsRateLimit   int
+	ExistsRateWindow  time.Duration
+	ProfileRateLimit  int
+	ProfileRateWindow time.Duration
+	ResetRateLimit    int
+	ResetRateWindow   time.Duration
+	PhoneRateLimit    int
+	PhoneRateWindow   time.Duration
+	MaxFailedLogins   int
+	LockoutDuration   time.Duration
+
+	PasswordMinLength       int
+	MinAge                  int
+	DefaultPhoneCountryCode string
+	EmailDomainAllowlist    []string
+	EmailDomainBlocklist    []string
+
+	EventPublisher         string
+	MetricsPath            string
+	MetricsRefreshInterval time.Duration
+	OTLPEndpoint           string
+	OutboxPollInterval     time.Duration
+	WebhookPollInterval    time.Duration
+}
+
+// loadConfig reads Config from the environment, applying defaults to optional
+// settings. It fails listing every required variable that is unset and every
+// one that is set to something invalid, so a misconfigured deployment is
+// fixed in one pass.
+func loadConfig() (*Config, error) {
+	env := &envReader{}
+	cfg := &Config{
+		DatabaseDSN:          strings.TrimSpace(os.Getenv("DB_DSN")),
+		DBConnectRetries:     env.atLeast("DB_CONNECT_RETRIES", defaultConnectRetries, 1),
+		DBConnectBackoff:     env.duration("DB_CONNECT_BACKOFF", defaultConnectBackoff),
+		DBMaxOpenConns:       env.atLeast("DB_MAX_OPEN_CONNS", defaultMaxOpenConns, 1),
+		DBMaxIdleConns:       env.atLeast("DB_MAX_IDLE_CONNS", defaultMaxIdleConns, 1),
+		DBConnMaxLifetime:    env.duration("DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime),
+		DBLogLevel:           env.string("DB_LOG_LEVEL", defaultDBLogLevel),
+		DBSlowQueryThreshold: env.duration("DB_SLOW_QUERY_THRESHOLD", defaultSlowQueryThreshold),
+		RunMigrations:        env.bool("RUN_MIGRATIONS", true),
+
+		Addr:            resolveAddr(),
+		AppEnv:          os.Getenv("APP_ENV"),
+		TLSCertFile:     os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:      os.Getenv("TLS_KEY_FILE"),
+		TLSRedirectAddr: os.Getenv("TLS_REDIRECT_ADDR"),
+		RequestTimeout:  env.duration("REQUEST_TIMEOUT", defaultRequestTimeout),
+		BodyLimit:       env.size("BODY_LIMIT", defaultBodyLimit),
+		ImportBodyLimit: env.size("IMPORT_BODY_LIMIT", defaultImportBodyLimit),
+		GzipLevel:       env.between("GZIP_LEVEL", defaultGzipLevel, -2, 9),
+		UserCountPublic: env.bool("USER_COUNT_PUBLIC", false),
+		DefaultPageSize: env.atLeast("DEFAULT_PAGE_SIZE", defaultPageSize, 1),
+		MaxPageSize:     env.atLeast("MAX_PAGE_SIZE", defaultMaxPageSize, 1),
+		AvatarDir:       env.string("AVATAR_DIR", defaultAvatarDir),
+		AppBaseURL:      strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/"),
+
+		CORSAllowedOrigins: env.list("CORS_ALLOWED_ORIGINS"),
+		CORSAllowedMethods: env.list("CORS_ALLOWED_METHODS"),
+		CORSAllowedHeaders: env.list("CORS_ALLOWED_HEADERS"),
+
+		SMTPHost:        os.Getenv("SMTP_HOST"),
+		SMTPPort:        env.string("SMTP_PORT", defaultSMTPPort),
+		SMTPUsername:    os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:    os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:        os.Getenv("SMTP_FROM"),
+		MailTemplateDir: os.Getenv("MAIL_TEMPLATE_DIR"),
+
+		JWTSecret:         os.Getenv("JWT_SECRET"),
+		AccessTokenTTL:    env.duration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL),
+		RefreshTokenTTL:   env.duration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL),
+		PasswordResetTTL:  env.duration("PASSWORD_RESET_TTL", defaultPasswordResetTTL),
+		PhoneOTPTTL:       env.duration("PHONE_OTP_TTL", defaultPhoneOTPTTL),
+		IdempotencyKeyTTL: env.duration("IDEMPOTENCY_KEY_TTL", defaultIdempotencyKeyTTL),
+		// 0 turns the history off.
+		PasswordHistorySize: env.atLeast("PASSWORD_HISTORY_SIZE", defaultPasswordHistorySize, 0),
+		BcryptCost:          env.between("BCRYPT_COST", bcrypt.DefaultCost, bcrypt.MinCost, bcrypt.MaxCost),
+		MFAEncryptionKey:    os.Getenv("MFA_ENCRYPTION_KEY"),
+
+		LoginRateLimit:    env.atLeast("LOGIN_RATE_LIMIT", defaultLoginRateLimit, 1),
+		LoginRateWindow:   env.duration("LOGIN_RATE_WINDOW", defaultLoginRateWindow),
+		ExistsRateLimit:   env.atLeast("EXISTS_RATE_LIMIT", defaultExistsRateLimit, 1),
+		ExistsRateWindow:  env.duration("EXISTS_RATE_WINDOW", defaultExistsRateWindow),
+		ProfileRateLimit:  env.atLeast("PROFILE_RATE_LIMIT", defaultProfileRateLimit, 1),
+		ProfileRateWindow: env.duration("PROFILE_RATE_WINDOW", defaultProfileRateWindow),
+		ResetRateLimit:    env.atLeast("PASSWORD_RESET_RATE_LIMIT", defaultResetRateLimit, 1),
+		ResetRateWindow:   env.duration("PASSWORD_RESET_RATE_WINDOW", defaultResetRateWindow),
+		PhoneRateLimit:    env.atLeast("PHONE_VERIFY_RATE_LIMIT", defaultPhoneRateLimit, 1),
+		PhoneRateWindow:   env.duration("PHONE_VERIFY_RATE_WINDOW", defaultPhoneRateWindow),
+		MaxFailedLogins:   env.atLeast("MAX_FAILED_LOGINS", defaultMaxFailedLogins, 1),
+		LockoutDuration:   env.duration("LOCKOUT_DURATION", defaultLockoutDuration),
+
+		PasswordMinLength:       env.atLeast("PASSWORD_MIN_LENGTH", defaultPasswordMinLength, 1),
+		MinAge:                  env.atLeast("MIN_AGE", defaultMinAge, 1),
+		DefaultPhoneCountryCode: strings.TrimPrefix(env.string("DEFAULT_PHONE_COUNTRY_CODE", defaultPhoneCountryCode), "+"),
+		EmailDomainAllowlist:    env.list("EMAIL_DOMAIN_ALLOWLIST"),
+		EmailDomainBlocklist:    env.list("EMAIL_DOMAIN_BLOCKLIST"),
+
+		EventPublisher:         os.Getenv("EVENT_PUBLISHER"),
+		MetricsPath:            env.string("METRICS_PATH", defaultMetricsPath),
+		MetricsRefreshInterval: env.duration("METRICS_REFRESH_INTERVAL", defaultMetricsRefreshInterval),
+		OTLPEndpoint:           os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		OutboxPollInterval:     env.duration("OUTBOX_POLL_INTERVAL", defaultOutboxPollInterval),
+		WebhookPollInterval:    env.duration("WEBHOOK_POLL_INTERVAL", defaultWebhookPollInterval),
+	}
+
+	var missing []string
+	if cfg.DatabaseDSN == "" {
+		missing = append(missing, "DB_DSN")
+	}
+	if cfg.JWTSecret == "" {
+		missing = append(missing, "JWT_SECRET")
+	}
+	// Links in emails must never be built from the request's Host header,
+	// which the sender controls.
+	if cfg.AppBaseURL == "" && cfg.SMTPHost != "" {
+		missing = append(missing, "APP_BASE_URL")
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing required environment variables: "+strings.Join(missing, ", "))
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		env.fail("TLS_CERT_FILE and TLS_KEY_FILE", "set together")
+	}
+	if cfg.DefaultPageSize > cfg.MaxPageSize {
+		env.fail("DEFAULT_PAGE_SIZE", "at most MAX_PAGE_SIZE")
+	}
+	if _, ok := gormLogLevels[cfg.DBLogLevel]; !ok {
+		env.fail("DB_LOG_LEVEL", "one of silent, error, warn or info")
+	}
+	// Left empty, MFA is off; a short key would make the TOTP secrets easy to
+	// brute-force.
+	if cfg.MFAEncryptionKey != "" && len(cfg.MFAEncryptionKey) < minMFAKeyLength {
+		env.fail("MFA_ENCRYPTION_KEY", fmt.Sprintf("at least %d characters", minMFAKeyLength))
+	}
+	if cfg.AppBaseURL == "" {
+		cfg.AppBaseURL = localBaseURL(cfg.Addr)
+	} else if u, err := url.Parse(cfg.AppBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		env.fail("APP_BASE_URL", "an absolute URL")
+	}
+	if !strings.HasPrefix(cfg.MetricsPath, "/") {
+		env.fail("METRICS_PATH", "a path starting with /")
+	}
+	if code := cfg.DefaultPhoneCountryCode; code == "" || strings.Trim(code, "0123456789") != "" {
+		env.fail("DEFAULT_PHONE_COUNTRY_CODE", "a numeric calling code")
+	}
+	if len(env.invalid) > 0 {
+		problems = append(problems, "invalid environment variables: "+strings.Join(env.invalid, "; "))
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return cfg, nil
+}
+
+// envReader reads optional settings from the environment. A variable that is
+// set but invalid is noted rather than replaced by its default, so loadConfig
+// can refuse to start.
+type envReader struct {
+	invalid []string
+}
+
+func (r *envReader) fail(name, want string) {
+	r.invalid = append(r.invalid, name+" must be "+want)
+}
+
+// string returns the variable, or def when it is unset or empty.
+func (r *envReader) string(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// atLeast reads an integer no smaller than min.
+func (r *envReader) atLeast(name string, def, min int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		r.fail(name, fmt.Sprintf("an integer of at least %d", min))
+		return def
+	}
+	return n
+}
+
+// between reads an integer from min to max.
+func (r *envReader) between(name string, def, min, max int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		r.fail(name, fmt.Sprintf("an integer from %d to %d", min, max))
+		return def
+	}
+	return n
+}
+
+// duration reads a positive time.Duration such as "90s".
+func (r *envReader) duration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		r.fail(name, `a positive duration such as "90s"`)
+		return def
+	}
+	return d
+}
+
+func (r *envReader) bool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.fail(name, "true or false")
+		return def
+	}
+	return b
+}
+
+// size reads a byte size such as "1M", in the form Echo's body limits take.
+func (r *envReader) size(name, def string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	if _, err := bytes.Parse(value); err != nil {
+		r.fail(name, `a size such as "1M"`)
+		return def
+	}
+	return value
+}
+
+// list reads a comma-separated list, dropping empty entries.
+func (r *envReader) list(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// resolveAddr returns the listen address from SERVER_ADDR or PORT, accepting
+// either a bare port ("8080") or a full address ("0.0.0.0:9000").
+func resolveAddr() string {
+	addr := os.Getenv("SERVER_ADDR")
+	if addr == "" {
+		addr = os.Getenv("PORT")
+	}
+	if addr == "" {
+		return defaultAddr
+	}
+	if !strings.Contains(addr, ":") {
+		return ":" + addr
+	}
+	return addr
+}
+
+// localBaseURL is the base URL of links in logged emails during development,
+// when APP_BASE_URL is unset.
+func localBaseURL(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "http://localhost" + addr
+	}
+	return "http://" + addr
+}
+
+// UseTLS reports whether the server should serve HTTPS.
+func (cfg *Config) UseTLS() bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
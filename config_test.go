@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	for name, value := range map[string]string{
+		"BODY_LIMIT":            "lots",
+		"IMPORT_BODY_LIMIT":     "10 parsecs",
+		"GZIP_LEVEL":            "10",
+		"BCRYPT_COST":           "3",
+		"LOGIN_RATE_LIMIT":      "many",
+		"PASSWORD_HISTORY_SIZE": "-1",
+		"REQUEST_TIMEOUT":       "soon",
+		"RUN_MIGRATIONS":        "maybe",
+		"DB_LOG_LEVEL":          "loud",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			_, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), name+" must be") {
+				t.Fatalf("loadConfig() with %s=%q returned %v", name, value, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("GZIP_LEVEL", "-3")
+	t.Setenv("BODY_LIMIT", "x")
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("loadConfig() succeeded")
+	}
+	for _, want := range []string{"JWT_SECRET", "GZIP_LEVEL", "BODY_LIMIT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestLoadConfigRequiresDBDSN(t *testing.T) {
+	for _, dsn := range []string{"", "  \t"} {
+		t.Setenv("DB_DSN", dsn)
+		_, err := loadConfig()
+		if err == nil || !strings.Contains(err.Error(), "missing required environment variables: DB_DSN") {
+			t.Errorf("loadConfig() with DB_DSN=%q returned %v", dsn, err)
+		}
+	}
+	t.Setenv("DB_DSN", " host=localhost dbname=ums ")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DatabaseDSN != "host=localhost dbname=ums" {
+		t.Errorf("DatabaseDSN = %q, want it trimmed", cfg.DatabaseDSN)
+	}
+}
+
+func TestLoadConfigAcceptsValidValues(t *testing.T) {
+	t.Setenv("BODY_LIMIT", "2M")
+	t.Setenv("GZIP_LEVEL", "-2")
+	t.Setenv("PASSWORD_HISTORY_SIZE", "0")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example, ,https://b.example")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BodyLimit != "2M" || cfg.GzipLevel != -2 || cfg.PasswordHistorySize != 0 {
+		t.Errorf("got BodyLimit %q, GzipLevel %d, PasswordHistorySize %d", cfg.BodyLimit, cfg.GzipLevel, cfg.PasswordHistorySize)
+	}
+	if len(cfg.CORSAllowedOrigins) != 2 {
+		t.Errorf("CORSAllowedOrigins = %q", cfg.CORSAllowedOrigins)
+	}
+}
+
+func TestLoadConfigPageSizes(t *testing.T) {
+	t.Setenv("DEFAULT_PAGE_SIZE", "")
+	t.Setenv("MAX_PAGE_SIZE", "")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DefaultPageSize != defaultPageSize || cfg.MaxPageSize != defaultMaxPageSize {
+		t.Errorf("got DefaultPageSize %d, MaxPageSize %d; want %d, %d", cfg.DefaultPageSize, cfg.MaxPageSize, defaultPageSize, defaultMaxPageSize)
+	}
+
+	t.Setenv("DEFAULT_PAGE_SIZE", "25")
+	t.Setenv("MAX_PAGE_SIZE", "25")
+	if cfg, err = loadConfig(); err != nil || cfg.DefaultPageSize != 25 || cfg.MaxPageSize != 25 {
+		t.Errorf("loadConfig() with both sizes 25 = %+v, %v", cfg, err)
+	}
+
+	for name, value := range map[string]string{"DEFAULT_PAGE_SIZE": "0", "MAX_PAGE_SIZE": "-1"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), name+" must be") {
+				t.Errorf("loadConfig() with %s=%q returned %v", name, value, err)
+			}
+		})
+	}
+
+	t.Setenv("MAX_PAGE_SIZE", "10")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "DEFAULT_PAGE_SIZE must be at most MAX_PAGE_SIZE") {
+		t.Errorf("loadConfig() with a default above the maximum returned %v", err)
+	}
+}
+
+func TestResolveAddr(t *testing.T) {
+	for _, tc := range []struct {
+		serverAddr, port, want string
+	}{
+		{"", "", defaultAddr},
+		{"", "9000", ":9000"},
+		{"0.0.0.0:9000", "", "0.0.0.0:9000"},
+		{"7000", "9000", ":7000"},
+	} {
+		t.Setenv("SERVER_ADDR", tc.serverAddr)
+		t.Setenv("PORT", tc.port)
+		if got := resolveAddr(); got != tc.want {
+			t.Errorf("resolveAddr() with SERVER_ADDR=%q PORT=%q = %q, want %q", tc.serverAddr, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestUseTLS(t *testing.T) {
+	for _, tc := range []struct {
+		cert, key string
+		tls       bool
+	}{
+		{"", "", false},
+		{"cert.pem", "key.pem", true},
+	} {
+		t.Setenv("TLS_CERT_FILE", tc.cert)
+		t.Setenv("TLS_KEY_FILE", tc.key)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.UseTLS() != tc.tls {
+			t.Errorf("TLS_CERT_FILE=%q TLS_KEY_FILE=%q: UseTLS() = %v, want %v", tc.cert, tc.key, cfg.UseTLS(), tc.tls)
+		}
+	}
+	t.Setenv("TLS_KEY_FILE", "")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "TLS_CERT_FILE and TLS_KEY_FILE must be set together") {
+		t.Errorf("loadConfig() with only a certificate returned %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"net/url"
+)
+
+// cors allows the origins listed in CORS_ALLOWED_ORIGINS. Without that list
+// every cross-origin request is refused, except from localhost when APP_ENV
+// is "development". The ETag and pagination headers are exposed, since
+// browsers otherwise hide them from scripts.
+func cors(cfg *Config) echo.MiddlewareFunc {
+	config := middleware.CORSConfig{
+		AllowOrigins:     cfg.CORSAllowedOrigins,
+		AllowMethods:     cfg.CORSAllowedMethods,
+		AllowHeaders:     cfg.CORSAllowedHeaders,
+		AllowCredentials: true,
+		ExposeHeaders:    []string{"ETag", "Link", "X-Total-Count", "X-Page", "X-Per-Page"},
+	}
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = middleware.DefaultCORSConfig.AllowMethods
+	}
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = []string{
+			echo.HeaderAuthorization,
+			echo.HeaderContentType,
+			"If-Match",
+			"If-None-Match",
+			"Idempotency-Key",
+		}
+	}
+	if len(config.AllowOrigins) == 0 {
+		// An empty AllowOrigins means "*" to Echo, so decide per origin instead.
+		development := cfg.AppEnv == "development"
+		config.AllowOriginFunc = func(origin string) (bool, error) {
+			return development && isLocalhost(origin), nil
+		}
+	}
+	return middleware.CORSWithConfig(config)
+}
+
+func isLocalhost(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
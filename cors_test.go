@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	listed := &Config{CORSAllowedOrigins: []string{"https://app.example"}}
+	for _, tc := range []struct {
+		name    string
+		cfg     *Config
+		origin  string
+		allowed bool
+	}{
+		{"listed origin", listed, "https://app.example", true},
+		{"unlisted origin", listed, "https://evil.example", false},
+		{"production localhost", &Config{AppEnv: "production"}, "http://localhost:3000", false},
+		{"development localhost", &Config{AppEnv: "development"}, "http://localhost:3000", true},
+		{"development remote", &Config{AppEnv: "development"}, "https://app.example", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			req.Header.Set(echo.HeaderOrigin, tc.origin)
+			rec := httptest.NewRecorder()
+			handler := cors(tc.cfg)(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+			if err := handler(echo.New().NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin)
+			if tc.allowed && (got != tc.origin || rec.Header().Get(echo.HeaderAccessControlAllowCredentials) != "true") {
+				t.Errorf("Allow-Origin %q, Allow-Credentials %q; want %s with credentials",
+					got, rec.Header().Get(echo.HeaderAccessControlAllowCredentials), tc.origin)
+			}
+			if !tc.allowed && got != "" {
+				t.Errorf("Allow-Origin = %q, want none", got)
+			}
+		})
+	}
+}
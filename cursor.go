@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"time"
+)
+
+type (
+	// UserCursor marks the last user of a cursor page. Pages are ordered by
+	// created_at, then user_id, so new rows never shift later pages.
+	UserCursor struct {
+		ID        int       `json:"id"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	CursorMeta struct {
+		Limit      int    `json:"limit"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+)
+
+func encodeCursor(user *Users) (string, error) {
+	raw, err := json.Marshal(UserCursor{ID: user.UserID, CreatedAt: user.CreatedAt})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor parses a cursor from encodeCursor. The empty cursor starts at
+// the first page and decodes to nil.
+func decodeCursor(cursor string) (*UserCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var res UserCursor
+	if err := json.Unmarshal(raw, &res); err != nil || res.ID == 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	return &res, nil
+}
+
+// listByCursor serves GET /users in cursor mode, used whenever ?cursor= is
+// present. It does not count the total, which is what makes it cheap on
+// large tables.
+func (h *UserHandler) listByCursor(c echo.Context, opts UserListOptions) error {
+	if opts.SortBy != "" {
+		return respondError(c, http.StatusBadRequest, "sort is not supported with cursor pagination")
+	}
+	after, err := decodeCursor(c.QueryParam("cursor"))
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	fields := opts.Fields
+	if len(fields) > 0 {
+		// The cursor is built from these, whatever the caller asked for.
+		opts.Fields = append([]string{"user_id", "created_at"}, fields...)
+	}
+	limit := opts.Limit
+	opts.Limit++
+	res, err := h.users(c).FindAfter(after, opts)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	meta := CursorMeta{Limit: limit}
+	if len(res) > limit {
+		res = res[:limit]
+		if meta.NextCursor, err = encodeCursor(&res[limit-1]); err != nil {
+			return respondError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+	data, err := projectUsers(res, fields)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, data, meta)
+}
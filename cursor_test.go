@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	created := time.Date(2026, 10, 14, 9, 30, 0, 123456000, time.UTC)
+	cursor, err := encodeCursor(&Users{UserID: 42, CreatedAt: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 42 || !got.CreatedAt.Equal(created) {
+		t.Errorf("decodeCursor() = %+v, want user 42 created at %v", got, created)
+	}
+	if got, err := decodeCursor(""); got != nil || err != nil {
+		t.Errorf("decodeCursor(\"\") = %+v, %v; want the first page", got, err)
+	}
+}
+
+func TestDecodeCursorRejectsGarbage(t *testing.T) {
+	for _, cursor := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"created_at":"2026-10-14T00:00:00Z"}`)),
+	} {
+		if _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded", cursor)
+		}
+	}
+}
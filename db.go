@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"time"
+)
+
+// connectDB opens the database in cfg, retrying up to DBConnectRetries times
+// and doubling the wait after each failure, so the app survives a database
+// that is still starting up.
+func connectDB(cfg *Config) (*gorm.DB, error) {
+	attempts, backoff := cfg.DBConnectRetries, cfg.DBConnectBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var db *gorm.DB
+		db, err = gorm.Open(postgres.Open(cfg.DatabaseDSN), &gorm.Config{Logger: newGormLogger(cfg)})
+		if err == nil {
+			zap.L().Info("db connected", zap.Int("attempt", attempt))
+			return db, nil
+		}
+		zap.L().Warn("db connect failed", zap.Int("attempt", attempt), zap.Int("attempts", attempts), zap.Error(err))
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, fmt.Errorf("connecting to database after %d attempts: %w", attempts, err)
+}
+
+// configurePool applies the pool limits in cfg to the connection pool behind
+// db.
+func configurePool(db *gorm.DB, cfg *Config) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+	zap.L().Info("db pool configured",
+		zap.Int("max_open", cfg.DBMaxOpenConns),
+		zap.Int("max_idle", cfg.DBMaxIdleConns),
+		zap.Duration("max_lifetime", cfg.DBConnMaxLifetime),
+	)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigurePool(t *testing.T) {
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1"), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{DBMaxOpenConns: 7, DBMaxIdleConns: 3, DBConnMaxLifetime: time.Minute}
+	if err := configurePool(db, cfg); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if got := sqlDB.Stats().MaxOpenConnections; got != 7 {
+		t.Errorf("MaxOpenConnections = %d, want 7", got)
+	}
+}
+
+func TestConnectDBRetries(t *testing.T) {
+	cfg := &Config{
+		DatabaseDSN:      "host=127.0.0.1 port=1 connect_timeout=1",
+		DBConnectRetries: 3,
+		DBConnectBackoff: time.Millisecond,
+		DBLogLevel:       "silent",
+	}
+	start := time.Now()
+	_, err := connectDB(cfg)
+	if err == nil {
+		t.Fatal("connectDB() succeeded against a closed port")
+	}
+	if want := fmt.Sprintf("after %d attempts", cfg.DBConnectRetries); !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want it to say %q", err, want)
+	}
+	// Two waits between three attempts: 1ms, then 2ms.
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("connectDB() returned after %v, too soon to have backed off", elapsed)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// respondError writes an ErrorResponse, reporting failures caused by the
+// request deadline as 503 rather than a generic 500.
+func respondError(c echo.Context, code int, msg string) error {
+	return respondErrorDetails(c, code, msg, nil)
+}
+
+// respondErrorDetails is respondError with details on what went wrong.
+func respondErrorDetails(c echo.Context, code int, msg string, details interface{}) error {
+	if code == http.StatusInternalServerError && errors.Is(c.Request().Context().Err(), context.DeadlineExceeded) {
+		code, msg = http.StatusServiceUnavailable, "request timed out"
+	}
+	return c.JSON(code, ErrorResponse{Code: code, Message: msg, Details: details, RequestID: requestID(c)})
+}
+
+// errorMessage returns the client-facing message of err, unwrapping an
+// echo.HTTPError to its message.
+func errorMessage(err error) string {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return fmt.Sprint(he.Message)
+	}
+	return err.Error()
+}
+
+func requestID(c echo.Context) string {
+	return c.Response().Header().Get(echo.HeaderXRequestID)
+}
+
+// httpErrorHandler renders every error that reaches Echo, including validation
+// failures and recovered panics, as an ErrorResponse. Validation failures list
+// each offending field in Details.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	res := ErrorResponse{
+		Code:      http.StatusInternalServerError,
+		Message:   err.Error(),
+		RequestID: requestID(c),
+	}
+	var he *echo.HTTPError
+	var ve *ValidationError
+	switch {
+	case errors.As(err, &ve):
+		ve.localize(c.Request().Header.Get("Accept-Language"))
+		res.Code = http.StatusUnprocessableEntity
+		res.Message = ve.Error()
+		res.Details = ve.Errors
+	case errors.As(err, &he):
+		res.Code = he.Code
+		res.Message = fmt.Sprint(he.Message)
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(res.Code)
+	} else {
+		err = c.JSON(res.Code, res)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
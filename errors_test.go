@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPErrorHandler(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for _, tc := range []struct {
+		err        error
+		code       int
+		hasDetails bool
+	}{
+		{echo.NewHTTPError(http.StatusNotFound, "user not found"), http.StatusNotFound, false},
+		{cv.Validate(&UserRequest{}), http.StatusUnprocessableEntity, true},
+		{errors.New("boom"), http.StatusInternalServerError, false},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.Response().Header().Set(echo.HeaderXRequestID, "req-1")
+		httpErrorHandler(tc.err, c)
+
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tc.code || res.Code != tc.code || res.Message == "" || res.RequestID != "req-1" {
+			t.Errorf("%v: status %d, body %+v; want code %d with a message and request id", tc.err, rec.Code, res, tc.code)
+		}
+		if (res.Details != nil) != tc.hasDetails {
+			t.Errorf("%v: details = %v", tc.err, res.Details)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+)
+
+// respondCacheable writes data like respondOK, tagged with an ETag hashed from
+// the body so any visible change, including a different ?fields= projection,
+// yields a new tag. A request whose If-None-Match already holds the tag gets
+// 304 Not Modified without the body.
+func respondCacheable(c echo.Context, data interface{}) error {
+	body, err := json.Marshal(SuccessResponse{Data: data})
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Response().Header().Set("ETag", etag)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison RFC 9110 prescribes for it.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
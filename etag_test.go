@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	for header, want := range map[string]bool{
+		"":                 false,
+		`"abc"`:            true,
+		`W/"abc"`:          true,
+		`"xyz", "abc"`:     true,
+		` "xyz" ,W/"abc" `: true,
+		"*":                true,
+		`"ab"`:             false,
+		`abc`:              false,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", header, etag, got, want)
+		}
+	}
+}
+
+func TestRespondCacheable(t *testing.T) {
+	respond := func(data interface{}, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		if err := respondCacheable(echo.New().NewContext(req, rec), data); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+	first := respond(echo.Map{"id": 1}, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.String() != `{"data":{"id":1}}` {
+		t.Fatalf("got %d with ETag %q and body %s", first.Code, etag, first.Body)
+	}
+	if again := respond(echo.Map{"id": 1}, ""); again.Header().Get("ETag") != etag {
+		t.Errorf("ETag changed from %s to %s for the same body", etag, again.Header().Get("ETag"))
+	}
+	if changed := respond(echo.Map{"id": 2}, ""); changed.Header().Get("ETag") == etag {
+		t.Error("ETag did not change with the body")
+	}
+	cached := respond(echo.Map{"id": 1}, etag)
+	if cached.Code != http.StatusNotModified || cached.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: got %d with body %q, want 304 and no body", cached.Code, cached.Body)
+	}
+	if cached.Header().Get("ETag") != etag {
+		t.Errorf("304 ETag = %q, want %q", cached.Header().Get("ETag"), etag)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+type EventType string
+
+const (
+	UserCreated  EventType = "user.created"
+	UserUpdated  EventType = "user.updated"
+	UserDeleted  EventType = "user.deleted"
+	UserRestored EventType = "user.restored"
+)
+
+var errEventBufferFull = errors.New("event buffer full")
+
+type (
+	Event struct {
+		Type       EventType `json:"type"`
+		UserID     int       `json:"user_id"`
+		OccurredAt time.Time `json:"occurred_at"`
+	}
+
+	// EventPublisher hands user lifecycle events to whoever needs to react
+	// to them. Implementations must be safe for concurrent use.
+	EventPublisher interface {
+		Publish(event Event) error
+	}
+
+	noopPublisher struct{}
+
+	// fanOutPublisher publishes each event to every publisher in turn,
+	// returning the first error once all have been tried.
+	fanOutPublisher []EventPublisher
+
+	// ChannelPublisher delivers events in-process over a buffered channel.
+	ChannelPublisher struct {
+		events chan Event
+	}
+)
+
+func (noopPublisher) Publish(Event) error {
+	return nil
+}
+
+func (p fanOutPublisher) Publish(event Event) error {
+	var first error
+	for _, publisher := range p {
+		if err := publisher.Publish(event); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func NewChannelPublisher(buffer int) *ChannelPublisher {
+	return &ChannelPublisher{events: make(chan Event, buffer)}
+}
+
+// Publish queues event without blocking the caller, failing if the buffer is
+// full.
+func (p *ChannelPublisher) Publish(event Event) error {
+	select {
+	case p.events <- event:
+		return nil
+	default:
+		return errEventBufferFull
+	}
+}
+
+func (p *ChannelPublisher) Events() <-chan Event {
+	return p.events
+}
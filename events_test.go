@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChannelPublisher(t *testing.T) {
+	p := NewChannelPublisher(1)
+	if err := p.Publish(Event{Type: UserCreated, UserID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(Event{Type: UserDeleted, UserID: 1}); !errors.Is(err, errEventBufferFull) {
+		t.Errorf("Publish() to a full buffer = %v, want %v", err, errEventBufferFull)
+	}
+	if event := <-p.Events(); event.Type != UserCreated || event.UserID != 1 {
+		t.Errorf("received %+v, want user 1 created", event)
+	}
+}
+
+type failingPublisher struct{ err error }
+
+func (p failingPublisher) Publish(Event) error {
+	return p.err
+}
+
+func TestFanOutPublisher(t *testing.T) {
+	errFirst, errSecond := errors.New("first"), errors.New("second")
+	ch := NewChannelPublisher(1)
+	p := fanOutPublisher{failingPublisher{errFirst}, ch, failingPublisher{errSecond}}
+	if err := p.Publish(Event{Type: UserUpdated, UserID: 2}); !errors.Is(err, errFirst) {
+		t.Errorf("Publish() = %v, want %v", err, errFirst)
+	}
+	select {
+	case <-ch.Events():
+	default:
+		t.Error("a failing publisher kept the event from the ones after it")
+	}
+}
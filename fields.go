@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"strings"
+)
+
+// selectableFields are the user columns ?fields= may ask for. They double as
+// JSON names, and never include secrets such as the password hash.
+var selectableFields = map[string]bool{
+	"user_id":       true,
+	"username":      true,
+	"first_name":    true,
+	"last_name":     true,
+	"phone":         true,
+	"email":         true,
+	"birthday":      true,
+	"timezone":      true,
+	"is_active":     true,
+	"role":          true,
+	"avatar_url":    true,
+	"last_login_at": true,
+	"created_at":    true,
+	"updated_at":    true,
+}
+
+// parseFields returns the columns named by ?fields=, or nil when every field
+// was requested.
+func parseFields(c echo.Context) ([]string, error) {
+	raw := c.QueryParam("fields")
+	if raw == "" {
+		return nil, nil
+	}
+	var fields []string
+	seen := map[string]bool{}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if !selectableFields[field] {
+			return nil, errors.New("invalid field: " + field)
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// projectUser renders user with only fields, or whole when fields is empty.
+func projectUser(user *Users, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return user, nil
+	}
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, err
+	}
+	res := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		res[field] = all[field]
+	}
+	return res, nil
+}
+
+func projectUsers(users []Users, fields []string) (interface{}, error) {
+	if len(fields) == 0 {
+		return users, nil
+	}
+	res := make([]interface{}, len(users))
+	for i := range users {
+		projected, err := projectUser(&users[i], fields)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = projected
+	}
+	return res, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	for query, want := range map[string][]string{
+		"":                                 nil,
+		"fields=user_id,username":          {"user_id", "username"},
+		"fields=email,%20email%20,user_id": {"email", "user_id"},
+		"fields=last_login_at,avatar_url":  {"last_login_at", "avatar_url"},
+	} {
+		got, err := parseFields(queryContext(query))
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%q: parseFields() = %q, %v; want %q", query, got, err, want)
+		}
+	}
+	for _, query := range []string{"fields=password", "fields=username,nope", "fields=user_id,"} {
+		if _, err := parseFields(queryContext(query)); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+}
+
+func TestProjectUser(t *testing.T) {
+	projected, err := projectUser(&Users{UserID: 3, Username: "alice", Email: "alice@example.com"}, []string{"user_id", "email"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(projected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"email":"alice@example.com","user_id":3}` {
+		t.Errorf("projected user = %s, want only user_id and email", raw)
+	}
+}
@@ -0,0 +1,1473 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UserHandler struct {
+	cfg    *Config
+	repo   UserRepository
+	tokens RefreshTokenRepository
+	resets PasswordResetRepository
+	mailer Mailer
+	sms    SMSSender
+}
+
+func NewUserHandler(cfg *Config, repo UserRepository, tokens RefreshTokenRepository, resets PasswordResetRepository, mailer Mailer, sms SMSSender) *UserHandler {
+	return &UserHandler{cfg: cfg, repo: repo, tokens: tokens, resets: resets, mailer: mailer, sms: sms}
+}
+
+// users returns the user repository bound to the request context, so queries
+// stop when the client goes away or the request times out.
+func (h *UserHandler) users(c echo.Context) UserRepository {
+	return h.repo.WithContext(c.Request().Context())
+}
+
+func (h *UserHandler) refreshTokens(c echo.Context) RefreshTokenRepository {
+	return h.tokens.WithContext(c.Request().Context())
+}
+
+func (h *UserHandler) passwordResets(c echo.Context) PasswordResetRepository {
+	return h.resets.WithContext(c.Request().Context())
+}
+
+var sortableColumns = map[string]bool{
+	"user_id":       true,
+	"username":      true,
+	"email":         true,
+	"created_at":    true,
+	"last_login_at": true,
+}
+
+// @Summary List users
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Page size" default(20)
+// @Param sort query string false "Sort column, prefix with - for descending"
+// @Param active query bool false "Filter on is_active"
+// @Param inactive_since query string false "Only users who have not logged in for this long, e.g. 90d"
+// @Param created_from query string false "Created at or after, RFC 3339 or YYYY-MM-DD"
+// @Param created_to query string false "Created at or before, RFC 3339 or YYYY-MM-DD"
+// @Param fields query string false "Comma-separated fields to return, e.g. user_id,username"
+// @Param cursor query string false "Switches to cursor pagination; pass meta.next_cursor of the previous page, or empty for the first"
+// @Success 200 {object} SuccessResponse{data=[]Users,meta=PageMeta}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users [get]
+func (h *UserHandler) List(c echo.Context) error {
+	page, limit := h.parsePagination(c)
+	opts := UserListOptions{Offset: (page - 1) * limit, Limit: limit}
+	if err := parseListOptions(c, &opts); err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	if _, ok := c.QueryParams()["cursor"]; ok {
+		return h.listByCursor(c, opts)
+	}
+	res, total, err := h.users(c).FindAll(opts)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	data, err := projectUsers(res, opts.Fields)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	setPaginationHeaders(c, page, limit, total)
+	return respondOK(c, http.StatusOK, data, PageMeta{Page: page, Limit: limit, Total: total})
+}
+
+// @Summary Count users
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param active query bool false "Filter on is_active"
+// @Param inactive_since query string false "Only users who have not logged in for this long, e.g. 90d"
+// @Param created_from query string false "Created at or after, RFC 3339 or YYYY-MM-DD"
+// @Param created_to query string false "Created at or before, RFC 3339 or YYYY-MM-DD"
+// @Success 200 {object} SuccessResponse{data=map[string]int64}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/count [get]
+func (h *UserHandler) Count(c echo.Context) error {
+	var opts UserListOptions
+	if err := parseListOptions(c, &opts); err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	total, err := h.users(c).Count(opts)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"total": total}, nil)
+}
+
+// Exists reports whether a username or email is already registered, so sign-up
+// forms can check availability without loading the user.
+// @Summary Check whether a username or email is taken
+// @Tags users
+// @Produce json
+// @Param username query string false "Username to check"
+// @Param email query string false "Email to check"
+// @Success 200 {object} SuccessResponse{data=map[string]bool}
+// @Failure 400 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/exists [get]
+func (h *UserHandler) Exists(c echo.Context) error {
+	username := normalizeUsername(c.QueryParam("username"))
+	email := normalizeEmail(c.QueryParam("email"))
+	if (username == "") == (email == "") {
+		return respondError(c, http.StatusBadRequest, "pass exactly one of username or email")
+	}
+	column, value := "username", username
+	if email != "" {
+		column, value = "email", email
+	}
+	exists, err := h.users(c).Exists(column, value)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"exists": exists}, nil)
+}
+
+// Search matches users whose username, names or email contain every word of
+// q as a prefix, most relevant first.
+// @Summary Search users
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param q query string true "Search words"
+// @Param page query int false "Page number" default(1)
+// @Param limit query int false "Page size" default(20)
+// @Param sort query string false "Sort column, prefix with - for descending; defaults to relevance"
+// @Param fields query string false "Comma-separated fields to return, e.g. user_id,username"
+// @Success 200 {object} SuccessResponse{data=[]Users,meta=PageMeta}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/search [get]
+func (h *UserHandler) Search(c echo.Context) error {
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return respondError(c, http.StatusBadRequest, "q is required")
+	}
+	page, limit := h.parsePagination(c)
+	opts := UserListOptions{Offset: (page - 1) * limit, Limit: limit}
+	if err := parseListOptions(c, &opts); err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	res, total, err := h.users(c).Search(q, opts)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	data, err := projectUsers(res, opts.Fields)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	setPaginationHeaders(c, page, limit, total)
+	return respondOK(c, http.StatusOK, data, PageMeta{Page: page, Limit: limit, Total: total})
+}
+
+const exportFlushEvery = 100
+
+var exportHeader = []string{"user_id", "username", "first_name", "last_name", "email", "phone", "birthday", "timezone", "is_active"}
+
+// @Summary Export users as CSV
+// @Tags users
+// @Produce text/csv
+// @Security BearerAuth
+// @Success 200 {file} file
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Router /users/export [get]
+func (h *UserHandler) Export(c echo.Context) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="users.csv"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	if err := w.Write(exportHeader); err != nil {
+		return err
+	}
+	rows := 0
+	err := h.users(c).Each(func(user *Users) error {
+		var birthday string
+		if user.Birthday != nil {
+			birthday = user.Birthday.Format("2006-01-02")
+		}
+		err := w.Write([]string{
+			strconv.Itoa(user.UserID),
+			user.Username,
+			user.FirstName,
+			user.LastName,
+			user.Email,
+			stringValue(user.Phone),
+			birthday,
+			user.Timezone,
+			strconv.FormatBool(user.IsActive),
+		})
+		if err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushEvery == 0 {
+			w.Flush()
+			res.Flush()
+		}
+		return w.Error()
+	})
+	if err != nil {
+		// Headers are already sent, so the error can only be logged.
+		c.Logger().Error(err)
+		return nil
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// @Summary Get a user
+// @Tags users
+// @Produce json
+// @Param id path int true "User ID"
+// @Param fields query string false "Comma-separated fields to return, e.g. user_id,username"
+// @Param If-None-Match header string false "ETag of a previous response; 304 is returned when it still matches"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Success 304 "Not Modified"
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id} [get]
+func (h *UserHandler) Get(c echo.Context) error {
+	return h.get(c, c.Param("id"))
+}
+
+// Batch loads several users in one query, keyed by id. Ids that match no
+// user are left out of the result.
+// @Summary Get several users by id
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param ids query string true "Comma-separated user ids, at most 100"
+// @Success 200 {object} SuccessResponse{data=map[string]Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/batch [get]
+func (h *UserHandler) Batch(c echo.Context) error {
+	raw := strings.Split(c.QueryParam("ids"), ",")
+	ids := make([]int, 0, len(raw))
+	for _, part := range raw {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return respondError(c, http.StatusBadRequest, "invalid id: "+part)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return respondError(c, http.StatusBadRequest, "ids is required")
+	}
+	if len(ids) > maxBatchIDs {
+		return respondError(c, http.StatusBadRequest, "at most "+strconv.Itoa(maxBatchIDs)+" ids are allowed")
+	}
+	res, err := h.users(c).FindByIDs(ids)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	byID := make(map[string]Users, len(res))
+	for _, user := range res {
+		byID[strconv.Itoa(user.UserID)] = user
+	}
+	return respondOK(c, http.StatusOK, byID, nil)
+}
+
+// Me returns the user the request's token was issued to.
+// @Summary Get the authenticated user
+// @Tags me
+// @Produce json
+// @Security BearerAuth
+// @Param fields query string false "Comma-separated fields to return, e.g. user_id,username"
+// @Param If-None-Match header string false "ETag of a previous response; 304 is returned when it still matches"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Success 304 "Not Modified"
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me [get]
+func (h *UserHandler) Me(c echo.Context) error {
+	return h.get(c, currentUserID(c))
+}
+
+func (h *UserHandler) get(c echo.Context, id string) error {
+	fields, err := parseFields(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	res, err := h.users(c).FindByID(id, fields...)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	data, err := projectUser(res, fields)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondCacheable(c, data)
+}
+
+// @Summary Create a user
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param user body UserRequest true "User"
+// @Param Idempotency-Key header string false "Replays the original response when a request is retried"
+// @Success 201 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users [post]
+func (h *UserHandler) Create(c echo.Context) error {
+	key := c.Request().Header.Get(headerIdempotencyKey)
+	var requestHash string
+	if key != "" {
+		var err error
+		if requestHash, err = hashRequestBody(c); err != nil {
+			return respondError(c, http.StatusBadRequest, "invalid request body")
+		}
+	}
+	var request UserRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	request.Phone = normalizePhone(request.Phone, h.cfg.DefaultPhoneCountryCode)
+	request.Email = normalizeEmail(request.Email)
+	request.Username = normalizeUsername(request.Username)
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	newData, token, err := newUser(request, h.cfg.BcryptCost)
+	if err != nil {
+		if errors.Is(err, errInvalidBirthday) {
+			return respondError(c, http.StatusUnprocessableEntity, err.Error())
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	var replay *IdempotencyKey
+	errCreated := h.users(c).Transaction(func(tx UserRepository) error {
+		if key != "" {
+			var err error
+			if replay, err = findReplay(tx, currentUserID(c), key, h.cfg.IdempotencyKeyTTL); err != nil || replay != nil {
+				return err
+			}
+		}
+		if err := tx.Create(newData); err != nil {
+			return err
+		}
+		if err := recordAudit(c, tx, auditCreate, nil, newData); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserCreated, newData.UserID); err != nil {
+			return err
+		}
+		if key == "" {
+			return nil
+		}
+		return recordIdempotencyKey(tx, currentUserID(c), key, requestHash, http.StatusCreated, SuccessResponse{Data: newData})
+	})
+	if errCreated != nil {
+		if field, ok := uniqueViolationField(errCreated); ok {
+			return respondError(c, http.StatusConflict, field+" already exists")
+		}
+		return respondError(c, http.StatusInternalServerError, errCreated.Error())
+	}
+	if replay != nil {
+		if replay.RequestHash != requestHash {
+			return respondError(c, http.StatusConflict, "idempotency key was already used with a different request")
+		}
+		return c.JSONBlob(replay.StatusCode, replay.Response)
+	}
+	h.sendMail(c, newData, "verification", verificationSubject, token)
+	return respondOK(c, http.StatusCreated, newData, nil)
+}
+
+var errInvalidBirthday = errors.New("birthday must be a valid date in YYYY-MM-DD format")
+
+// parseBirthday parses an optional YYYY-MM-DD birthday, returning nil when it
+// is empty.
+func parseBirthday(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	birthday, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, errInvalidBirthday
+	}
+	return &birthday, nil
+}
+
+// timezoneOrDefault returns tz, or UTC when it was omitted.
+func timezoneOrDefault(tz string) string {
+	if tz == "" {
+		return defaultTimezone
+	}
+	return tz
+}
+
+// newUser builds a new, unverified user from a validated request, with the
+// password hashed at cost, returning it along with its raw verification token.
+func newUser(request UserRequest, cost int) (*Users, string, error) {
+	birthday, err := parseBirthday(request.Birthday)
+	if err != nil {
+		return nil, "", err
+	}
+	password, err := hashPassword(request.Password, cost)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := randomToken(verificationTokenBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashToken(token)
+	return &Users{
+		Username:  request.Username,
+		Password:  password,
+		FirstName: request.FirstName,
+		LastName:  request.LastName,
+		Phone:     optionalString(request.Phone),
+		Email:     request.Email,
+		Birthday:  birthday,
+		Timezone:  timezoneOrDefault(request.Timezone),
+		Role:      roleUser,
+
+		VerificationTokenHash: &hash,
+	}, token, nil
+}
+
+// @Summary Verify an email address
+// @Tags users
+// @Produce json
+// @Param token query string true "Verification token"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/verify [get]
+func (h *UserHandler) Verify(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return respondError(c, http.StatusBadRequest, "token is required")
+	}
+	user, err := h.users(c).FindByVerificationHash(hashToken(token))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusBadRequest, "invalid verification token")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	before := *user
+	errActivate := h.users(c).Transaction(func(tx UserRepository) error {
+		if err := tx.Activate(user); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserUpdated, user.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditUpdate, &before, user)
+	})
+	if errActivate != nil {
+		return respondError(c, http.StatusInternalServerError, errActivate.Error())
+	}
+	return respondOK(c, http.StatusOK, user, nil)
+}
+
+// @Summary Partially update a user
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param user body UserEditRequest true "Fields to change"
+// @Param If-Match header string false "Version the client last read; required unless the body has version"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id} [patch]
+func (h *UserHandler) Update(c echo.Context) error {
+	return h.update(c, c.Param("id"))
+}
+
+// UpdateMe applies a partial update to the user the request's token was
+// issued to.
+// @Summary Partially update the authenticated user
+// @Tags me
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param user body UserEditRequest true "Fields to change"
+// @Param If-Match header string false "Version the client last read; required unless the body has version"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me [patch]
+func (h *UserHandler) UpdateMe(c echo.Context) error {
+	return h.update(c, currentUserID(c))
+}
+
+func (h *UserHandler) update(c echo.Context, id string) error {
+	var request UserEditRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	normalize(request.Phone, func(phone string) string {
+		return normalizePhone(phone, h.cfg.DefaultPhoneCountryCode)
+	})
+	normalize(request.Email, normalizeEmail)
+	normalize(request.Username, normalizeUsername)
+	// Empty values clear these rather than failing their format checks.
+	clearPhone := request.Phone != nil && *request.Phone == ""
+	if clearPhone {
+		request.Phone = nil
+	}
+	clearBirthday := request.Birthday != nil && *request.Birthday == ""
+	if clearBirthday {
+		request.Birthday = nil
+	}
+	if request.Timezone != nil && *request.Timezone == "" {
+		*request.Timezone = defaultTimezone
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	old, err := h.users(c).FindByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	before := *old
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		return respondError(c, http.StatusPreconditionRequired, err.Error())
+	}
+	if version != old.Version {
+		return respondError(c, http.StatusConflict, errVersionConflict.Error())
+	}
+
+	column, err := h.takenColumn(c, old, stringValue(request.Email), stringValue(request.Phone), stringValue(request.Username))
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if column != "" {
+		return respondError(c, http.StatusConflict, column+" already in use")
+	}
+
+	for _, f := range []struct {
+		value *string
+		dst   *string
+	}{
+		{request.Email, &old.Email},
+		{request.FirstName, &old.FirstName},
+		{request.LastName, &old.LastName},
+		{request.Username, &old.Username},
+		{request.Timezone, &old.Timezone},
+	} {
+		if f.value != nil {
+			*f.dst = *f.value
+		}
+	}
+	if request.Password != nil {
+		reused, err := h.applyPassword(c, old, *request.Password)
+		if err != nil {
+			return respondError(c, http.StatusInternalServerError, err.Error())
+		}
+		if reused {
+			return respondError(c, http.StatusUnprocessableEntity, passwordReusedMessage)
+		}
+	}
+	if clearPhone {
+		old.Phone = nil
+	} else if request.Phone != nil {
+		old.Phone = request.Phone
+	}
+	if clearBirthday {
+		old.Birthday = nil
+	} else if request.Birthday != nil {
+		birthday, err := parseBirthday(*request.Birthday)
+		if err != nil {
+			return respondError(c, http.StatusUnprocessableEntity, err.Error())
+		}
+		old.Birthday = birthday
+	}
+
+	errUpdate := h.users(c).Transaction(func(tx UserRepository) error {
+		// Replace rather than Update, so cleared fields are written too.
+		if err := tx.Replace(old); err != nil {
+			return err
+		}
+		if err := resetPhoneVerification(tx, &before, old); err != nil {
+			return err
+		}
+		if err := h.recordPasswordHistory(tx, &before, old); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserUpdated, old.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditUpdate, &before, old)
+	})
+	if errUpdate != nil {
+		if errors.Is(errUpdate, errVersionConflict) {
+			return respondError(c, http.StatusConflict, errUpdate.Error())
+		}
+		if field, ok := uniqueViolationField(errUpdate); ok {
+			return respondError(c, http.StatusConflict, field+" already in use")
+		}
+		return respondError(c, http.StatusInternalServerError, errUpdate.Error())
+	}
+	return respondOK(c, http.StatusOK, old, nil)
+}
+
+// @Summary Replace a user
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param user body UserRequest true "User"
+// @Param If-Match header string false "Version the client last read; required unless the body has version"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 428 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id} [put]
+func (h *UserHandler) Replace(c echo.Context) error {
+	var request UserRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	request.Phone = normalizePhone(request.Phone, h.cfg.DefaultPhoneCountryCode)
+	request.Email = normalizeEmail(request.Email)
+	request.Username = normalizeUsername(request.Username)
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	old, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	before := *old
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		return respondError(c, http.StatusPreconditionRequired, err.Error())
+	}
+	if version != old.Version {
+		return respondError(c, http.StatusConflict, errVersionConflict.Error())
+	}
+
+	column, err := h.takenColumn(c, old, request.Email, request.Phone, request.Username)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if column != "" {
+		return respondError(c, http.StatusConflict, column+" already in use")
+	}
+
+	birthday, err := parseBirthday(request.Birthday)
+	if err != nil {
+		return respondError(c, http.StatusUnprocessableEntity, err.Error())
+	}
+	reused, err := h.applyPassword(c, old, request.Password)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if reused {
+		return respondError(c, http.StatusUnprocessableEntity, passwordReusedMessage)
+	}
+	old.Username = request.Username
+	old.FirstName = request.FirstName
+	old.LastName = request.LastName
+	old.Phone = optionalString(request.Phone)
+	old.Email = request.Email
+	old.Birthday = birthday
+	old.Timezone = timezoneOrDefault(request.Timezone)
+
+	errReplace := h.users(c).Transaction(func(tx UserRepository) error {
+		if err := tx.Replace(old); err != nil {
+			return err
+		}
+		if err := resetPhoneVerification(tx, &before, old); err != nil {
+			return err
+		}
+		if err := h.recordPasswordHistory(tx, &before, old); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserUpdated, old.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditUpdate, &before, old)
+	})
+	if errReplace != nil {
+		if errors.Is(errReplace, errVersionConflict) {
+			return respondError(c, http.StatusConflict, errReplace.Error())
+		}
+		if field, ok := uniqueViolationField(errReplace); ok {
+			return respondError(c, http.StatusConflict, field+" already in use")
+		}
+		return respondError(c, http.StatusInternalServerError, errReplace.Error())
+	}
+	return respondOK(c, http.StatusOK, old, nil)
+}
+
+// normalize applies fn to the string behind p, if any.
+func normalize(p *string, fn func(string) string) {
+	if p != nil {
+		*p = fn(*p)
+	}
+}
+
+// optionalString returns a pointer to s, or nil when s is empty.
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// stringValue returns the string behind p, or "" when p is nil.
+func stringValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// expectedVersion returns the user version the client last read, taken from
+// an If-Match header such as "3" or from the body's version field.
+func expectedVersion(c echo.Context, body *int) (int, error) {
+	if match := c.Request().Header.Get("If-Match"); match != "" {
+		version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(match, "W/"), `"`))
+		if err != nil {
+			return 0, errors.New("If-Match must hold the user version")
+		}
+		return version, nil
+	}
+	if body == nil {
+		return 0, errors.New("send the user version in If-Match or the version field")
+	}
+	return *body, nil
+}
+
+// takenColumn returns the first of email, phone and username that is being
+// changed to a value another user already holds, or "" if none is.
+func (h *UserHandler) takenColumn(c echo.Context, user *Users, email, phone, username string) (string, error) {
+	for _, f := range []struct{ column, value, current string }{
+		{"email", email, user.Email},
+		{"phone", phone, stringValue(user.Phone)},
+		{"username", username, user.Username},
+	} {
+		if f.value == "" || f.value == f.current {
+			continue
+		}
+		taken, err := h.users(c).IsTaken(f.column, f.value, user.UserID)
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return f.column, nil
+		}
+	}
+	return "", nil
+}
+
+// @Summary Delete a user
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id} [delete]
+func (h *UserHandler) Delete(c echo.Context) error {
+	res, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	errDel := h.users(c).Transaction(func(tx UserRepository) error {
+		if err := tx.Delete(res); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserDeleted, res.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditDelete, res, nil)
+	})
+	if errDel != nil {
+		if errors.Is(errDel, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, errDel.Error())
+	}
+	return respondOK(c, http.StatusOK, res, nil)
+}
+
+// DeleteInactive soft-deletes every unverified user created more than
+// older_than ago, for periodic cleanup of abandoned signups.
+// @Summary Delete stale inactive users
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param older_than query string true "Minimum account age, e.g. 30d or 12h"
+// @Success 200 {object} SuccessResponse{data=map[string]int64}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/inactive [delete]
+func (h *UserHandler) DeleteInactive(c echo.Context) error {
+	raw := c.QueryParam("older_than")
+	if raw == "" {
+		return respondError(c, http.StatusBadRequest, "older_than is required")
+	}
+	age, err := parseAge(raw)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, err.Error())
+	}
+	var deleted []Users
+	errDel := h.users(c).Transaction(func(tx UserRepository) error {
+		var err error
+		if deleted, err = tx.DeleteInactiveBefore(time.Now().Add(-age)); err != nil {
+			return err
+		}
+		for i := range deleted {
+			if err := enqueueEvent(tx, UserDeleted, deleted[i].UserID); err != nil {
+				return err
+			}
+			if err := recordAudit(c, tx, auditDelete, &deleted[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errDel != nil {
+		return respondError(c, http.StatusInternalServerError, errDel.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"deleted": len(deleted)}, nil)
+}
+
+// BulkUpdate applies one patch to several users in a single transaction and
+// reports how many of them changed. Ids that match no user are skipped.
+// @Summary Update several users at once
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body BulkUpdateRequest true "User ids, at most 100, and the fields to set"
+// @Success 200 {object} SuccessResponse{data=map[string]int}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/bulk [patch]
+func (h *UserHandler) BulkUpdate(c echo.Context) error {
+	var request BulkUpdateRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if len(request.IDs) == 0 {
+		return respondError(c, http.StatusBadRequest, "ids is required")
+	}
+	if len(request.IDs) > maxBatchIDs {
+		return respondError(c, http.StatusBadRequest, "at most "+strconv.Itoa(maxBatchIDs)+" ids are allowed")
+	}
+	patch := request.Patch
+	if patch.IsActive == nil && patch.Role == nil {
+		return respondError(c, http.StatusBadRequest, "patch must set is_active or role")
+	}
+	if err := c.Validate(&patch); err != nil {
+		return err
+	}
+
+	updated := 0
+	errTx := h.users(c).Transaction(func(tx UserRepository) error {
+		users, err := tx.FindByIDs(request.IDs)
+		if err != nil {
+			return err
+		}
+		for i := range users {
+			user := &users[i]
+			before := *user
+			var columns []string
+			if patch.IsActive != nil && *patch.IsActive != user.IsActive {
+				user.IsActive = *patch.IsActive
+				columns = append(columns, "is_active")
+			}
+			if patch.Role != nil && *patch.Role != user.Role {
+				user.Role = *patch.Role
+				columns = append(columns, "role")
+			}
+			if len(columns) == 0 {
+				continue
+			}
+			if err := tx.UpdateColumns(user, columns...); err != nil {
+				return err
+			}
+			if err := enqueueEvent(tx, UserUpdated, user.UserID); err != nil {
+				return err
+			}
+			if err := recordAudit(c, tx, auditUpdate, &before, user); err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	})
+	if errTx != nil {
+		return respondError(c, http.StatusInternalServerError, errTx.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"updated": updated}, nil)
+}
+
+// parseAge parses a positive duration, accepting a whole number of days such
+// as "30d" besides the units time.ParseDuration knows.
+func parseAge(value string) (time.Duration, error) {
+	errAge := fmt.Errorf("invalid duration %q", value)
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || n < 1 {
+			return 0, errAge
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errAge
+	}
+	return d, nil
+}
+
+// @Summary Restore a deleted user
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/restore [post]
+func (h *UserHandler) Restore(c echo.Context) error {
+	res, err := h.users(c).FindDeletedByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	errRestore := h.users(c).Transaction(func(tx UserRepository) error {
+		if err := tx.Restore(res); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserRestored, res.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditRestore, nil, res)
+	})
+	if errRestore != nil {
+		return respondError(c, http.StatusInternalServerError, errRestore.Error())
+	}
+	return respondOK(c, http.StatusOK, res, nil)
+}
+
+// @Summary Deactivate a user
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/deactivate [post]
+func (h *UserHandler) Deactivate(c echo.Context) error {
+	return h.setActive(c, false)
+}
+
+// @Summary Reactivate a user
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/activate [post]
+func (h *UserHandler) Activate(c echo.Context) error {
+	return h.setActive(c, true)
+}
+
+// setActive flips is_active on the user, recording the change like any other
+// update. Inactive users cannot log in or refresh their tokens.
+func (h *UserHandler) setActive(c echo.Context, active bool) error {
+	user, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.IsActive == active {
+		return respondOK(c, http.StatusOK, user, nil)
+	}
+	before := *user
+	errSet := h.users(c).Transaction(func(tx UserRepository) error {
+		if err := tx.SetActive(user, active); err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserUpdated, user.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditUpdate, &before, user)
+	})
+	if errSet != nil {
+		return respondError(c, http.StatusInternalServerError, errSet.Error())
+	}
+	return respondOK(c, http.StatusOK, user, nil)
+}
+
+// @Summary Change a user's password
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param request body ChangePasswordRequest true "Passwords"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/{id}/change-password [post]
+func (h *UserHandler) ChangePassword(c echo.Context) error {
+	var request ChangePasswordRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	user, err := h.users(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if ok, err := h.checkPassword(c, user, request.CurrentPassword, "current password is incorrect"); !ok {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.NewPassword)) == nil {
+		return respondError(c, http.StatusUnprocessableEntity, "new password must differ from the current password")
+	}
+	reused, err := h.passwordReused(c, user, request.NewPassword)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if reused {
+		return respondError(c, http.StatusUnprocessableEntity, passwordReusedMessage)
+	}
+	errUpdate := h.users(c).Transaction(func(tx UserRepository) error {
+		return h.setPassword(c, tx, user, request.NewPassword)
+	})
+	if errUpdate != nil {
+		return respondError(c, http.StatusInternalServerError, errUpdate.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"message": "password updated"}, nil)
+}
+
+// @Summary Log in
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body LoginRequest true "Credentials"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 423 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /login [post]
+func (h *UserHandler) Login(c echo.Context) error {
+	var request LoginRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	user, err := h.users(c).FindByUsername(normalizeUsername(request.Username))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Spend the same bcrypt work as a wrong password would, so the
+			// response time does not reveal whether the username exists.
+			bcrypt.CompareHashAndPassword(dummyPasswordHash(h.cfg.BcryptCost), []byte(request.Password))
+			return respondError(c, http.StatusUnauthorized, invalidCredentials)
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if ok, err := h.checkPassword(c, user, request.Password, invalidCredentials); !ok {
+		return err
+	}
+	if user.MFAEnabled {
+		if request.MFACode == "" {
+			return respondError(c, http.StatusUnauthorized, "mfa code required")
+		}
+		ok, err := h.validMFACode(c, user, request.MFACode)
+		if err != nil {
+			return respondMFAError(c, err)
+		}
+		if !ok {
+			return h.failLogin(c, user, time.Now(), "invalid mfa code")
+		}
+	}
+	if user.FailedLoginCount > 0 || user.LockedUntil != nil {
+		user.FailedLoginCount = 0
+		user.LockedUntil = nil
+		if err := h.users(c).SaveLoginAttempts(user); err != nil {
+			return respondError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+	if !user.IsActive {
+		return respondError(c, http.StatusForbidden, "account is not verified or has been deactivated")
+	}
+	if err := h.users(c).RecordLogin(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	token, err := generateToken(*user, h.cfg.JWTSecret, h.cfg.AccessTokenTTL)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	refresh, err := randomToken(refreshTokenBytes)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	errCreate := h.refreshTokens(c).Create(&RefreshToken{
+		TokenHash: hashToken(refresh),
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(h.cfg.RefreshTokenTTL),
+		UserAgent: c.Request().UserAgent(),
+		IP:        c.RealIP(),
+	})
+	if errCreate != nil {
+		return respondError(c, http.StatusInternalServerError, errCreate.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"token": token, "refresh_token": refresh}, nil)
+}
+
+// checkPassword compares password with user's, counting a mismatch towards the
+// same lockout as failed logins and responding 401 with msg. A locked account
+// is only reported as such, with 423, once the right password is given, so
+// the lock does not reveal that the account exists. It reports whether the
+// caller may go on; otherwise the response has been written.
+func (h *UserHandler) checkPassword(c echo.Context, user *Users, password, msg string) (bool, error) {
+	now := time.Now()
+	locked := user.LockedUntil != nil && now.Before(*user.LockedUntil)
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		if locked {
+			return false, respondError(c, http.StatusUnauthorized, msg)
+		}
+		return false, h.failLogin(c, user, now, msg)
+	}
+	if locked {
+		return false, respondError(c, http.StatusLocked, "account is temporarily locked")
+	}
+	return true, nil
+}
+
+// failLogin counts a failed login against user, locking the account once
+// cfg.MaxFailedLogins is reached, and responds 401 with msg.
+func (h *UserHandler) failLogin(c echo.Context, user *Users, now time.Time, msg string) error {
+	if user.LockedUntil != nil {
+		// The previous lock has expired, so start counting afresh.
+		user.FailedLoginCount = 0
+		user.LockedUntil = nil
+	}
+	user.FailedLoginCount++
+	if user.FailedLoginCount >= h.cfg.MaxFailedLogins {
+		until := now.Add(h.cfg.LockoutDuration)
+		user.LockedUntil = &until
+	}
+	if err := h.users(c).SaveLoginAttempts(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondError(c, http.StatusUnauthorized, msg)
+}
+
+// @Summary Exchange a refresh token for an access token
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /refresh [post]
+func (h *UserHandler) Refresh(c echo.Context) error {
+	var request RefreshRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	rt, err := h.refreshTokens(c).FindByHash(hashToken(request.RefreshToken))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusUnauthorized, "invalid refresh token")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if rt.Revoked {
+		return respondError(c, http.StatusUnauthorized, "refresh token has been revoked")
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return respondError(c, http.StatusUnauthorized, "refresh token has expired")
+	}
+	user, err := h.users(c).FindByID(strconv.Itoa(rt.UserID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusUnauthorized, "invalid refresh token")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !user.IsActive {
+		return respondError(c, http.StatusForbidden, "account has been deactivated")
+	}
+	token, err := generateToken(*user, h.cfg.JWTSecret, h.cfg.AccessTokenTTL)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"token": token}, nil)
+}
+
+// @Summary Revoke a refresh token
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /logout [post]
+func (h *UserHandler) Logout(c echo.Context) error {
+	var request RefreshRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	rt, err := h.refreshTokens(c).FindByHash(hashToken(request.RefreshToken))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusUnauthorized, "invalid refresh token")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if err := h.refreshTokens(c).Revoke(rt); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"message": "logged out"}, nil)
+}
+
+// numericIDs answers 400 for any route whose :id path parameter is not an
+// integer, before a handler passes it to the database.
+func numericIDs(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		for i, name := range c.ParamNames() {
+			if name != "id" {
+				continue
+			}
+			if _, err := strconv.Atoi(c.ParamValues()[i]); err != nil {
+				return respondError(c, http.StatusBadRequest, "id must be an integer")
+			}
+		}
+		return next(c)
+	}
+}
+
+// parsePagination reads ?page= and ?limit= from the query string, falling back
+// to the defaults for missing or invalid values and clamping limit to
+// cfg.MaxPageSize.
+func (h *UserHandler) parsePagination(c echo.Context) (int, int) {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = defaultPage
+	}
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 {
+		limit = h.cfg.DefaultPageSize
+	}
+	if limit > h.cfg.MaxPageSize {
+		limit = h.cfg.MaxPageSize
+	}
+	return page, limit
+}
+
+// parseTimeBound parses an optional RFC 3339 timestamp or YYYY-MM-DD date. A
+// bare date used as an upper bound covers that whole day.
+func parseTimeBound(value string, upper bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return &t, nil
+}
+
+// parseListOptions applies the sort and filter query parameters to opts.
+// ?sort= takes a column from sortableColumns, with a leading "-" for
+// descending order. ?active= filters on is_active and is ignored unless it is
+// a valid boolean.
+func parseListOptions(c echo.Context, opts *UserListOptions) error {
+	if sort := c.QueryParam("sort"); sort != "" {
+		column := strings.TrimPrefix(sort, "-")
+		if !sortableColumns[column] {
+			return errors.New("invalid sort field: " + column)
+		}
+		opts.SortBy = column
+		opts.SortDesc = strings.HasPrefix(sort, "-")
+	}
+	if active, err := strconv.ParseBool(c.QueryParam("active")); err == nil {
+		opts.Active = &active
+	}
+	fields, err := parseFields(c)
+	if err != nil {
+		return err
+	}
+	opts.Fields = fields
+	if opts.CreatedFrom, err = parseTimeBound(c.QueryParam("created_from"), false); err != nil {
+		return errors.New("invalid created_from: " + c.QueryParam("created_from"))
+	}
+	if opts.CreatedTo, err = parseTimeBound(c.QueryParam("created_to"), true); err != nil {
+		return errors.New("invalid created_to: " + c.QueryParam("created_to"))
+	}
+	if opts.CreatedFrom != nil && opts.CreatedTo != nil && opts.CreatedFrom.After(*opts.CreatedTo) {
+		return errors.New("created_from must not be after created_to")
+	}
+	if raw := c.QueryParam("inactive_since"); raw != "" {
+		age, err := parseAge(raw)
+		if err != nil {
+			return errors.New("invalid inactive_since: " + raw)
+		}
+		since := time.Now().Add(-age)
+		opts.InactiveSince = &since
+	}
+	return nil
+}
+
+// setPaginationHeaders adds GitHub-style X-Total-Count, X-Page, X-Per-Page and
+// Link headers describing the current page of a list response.
+func setPaginationHeaders(c echo.Context, page, limit int, total int64) {
+	header := c.Response().Header()
+	header.Set("X-Total-Count", strconv.FormatInt(total, 10))
+	header.Set("X-Page", strconv.Itoa(page))
+	header.Set("X-Per-Page", strconv.Itoa(limit))
+
+	last := int((total + int64(limit) - 1) / int64(limit))
+	if last < 1 {
+		last = 1
+	}
+	link := func(p int, rel string) string {
+		u := *c.Request().URL
+		u.Scheme = c.Scheme()
+		u.Host = c.Request().Host
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("limit", strconv.Itoa(limit))
+		u.RawQuery = q.Encode()
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+	links := []string{link(1, "first")}
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	header.Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// queryContext returns a context for a GET with the given query string.
+func queryContext(query string) echo.Context {
+	req := httptest.NewRequest(http.MethodGet, "/users?"+query, nil)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestParseListOptionsSort(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		column string
+		desc   bool
+	}{
+		{"", "", false},
+		{"sort=username", "username", false},
+		{"sort=-created_at", "created_at", true},
+	} {
+		var opts UserListOptions
+		if err := parseListOptions(queryContext(tc.query), &opts); err != nil {
+			t.Fatalf("%s: %v", tc.query, err)
+		}
+		if opts.SortBy != tc.column || opts.SortDesc != tc.desc {
+			t.Errorf("%s: sort %q desc %v, want %q desc %v", tc.query, opts.SortBy, opts.SortDesc, tc.column, tc.desc)
+		}
+	}
+	var opts UserListOptions
+	if err := parseListOptions(queryContext("sort=password"), &opts); err == nil {
+		t.Error("sort=password was accepted")
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	h := &UserHandler{cfg: &Config{DefaultPageSize: 20, MaxPageSize: 50}}
+	for _, tc := range []struct {
+		query       string
+		page, limit int
+	}{
+		{"", defaultPage, 20},
+		{"page=3&limit=10", 3, 10},
+		{"page=0&limit=0", defaultPage, 20},
+		{"page=-2&limit=-5", defaultPage, 20},
+		{"page=x&limit=y", defaultPage, 20},
+		{"limit=50", defaultPage, 50},
+		{"limit=51", defaultPage, 50},
+		{"limit=100000", defaultPage, 50},
+	} {
+		page, limit := h.parsePagination(queryContext(tc.query))
+		if page != tc.page || limit != tc.limit {
+			t.Errorf("%q: got page %d, limit %d; want %d, %d", tc.query, page, limit, tc.page, tc.limit)
+		}
+	}
+}
+
+func TestSetPaginationHeaders(t *testing.T) {
+	c := queryContext("active=true&page=2&limit=10")
+	setPaginationHeaders(c, 2, 10, 35)
+	header := c.Response().Header()
+	for name, want := range map[string]string{
+		"X-Total-Count": "35",
+		"X-Page":        "2",
+		"X-Per-Page":    "10",
+		"Link": `<http://example.com/users?active=true&limit=10&page=1>; rel="first", ` +
+			`<http://example.com/users?active=true&limit=10&page=1>; rel="prev", ` +
+			`<http://example.com/users?active=true&limit=10&page=3>; rel="next", ` +
+			`<http://example.com/users?active=true&limit=10&page=4>; rel="last"`,
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseListOptionsActive(t *testing.T) {
+	for query, want := range map[string]string{
+		"active=true":  "true",
+		"active=false": "false",
+		"":             "<nil>",
+		"active=maybe": "<nil>",
+	} {
+		var opts UserListOptions
+		if err := parseListOptions(queryContext(query), &opts); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		got := "<nil>"
+		if opts.Active != nil {
+			got = strconv.FormatBool(*opts.Active)
+		}
+		if got != want {
+			t.Errorf("%q: active = %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"1d":  24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		if got, err := parseAge(value); err != nil || got != want {
+			t.Errorf("parseAge(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "0d", "-3d", "d", "1.5d", "0s", "-1h", "soon"} {
+		if _, err := parseAge(value); err == nil {
+			t.Errorf("parseAge(%q) succeeded", value)
+		}
+	}
+}
+
+func TestParseListOptionsInactiveSince(t *testing.T) {
+	var opts UserListOptions
+	if err := parseListOptions(queryContext("inactive_since=90d"), &opts); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Now().Add(-90 * 24 * time.Hour)
+	if opts.InactiveSince == nil || opts.InactiveSince.Before(want.Add(-time.Minute)) || opts.InactiveSince.After(want) {
+		t.Errorf("inactive_since = %v, want about %v", opts.InactiveSince, want)
+	}
+	if err := parseListOptions(queryContext("inactive_since=lately"), &UserListOptions{}); err == nil {
+		t.Error("inactive_since=lately was accepted")
+	}
+}
+
+func TestParseListOptionsCreatedRange(t *testing.T) {
+	var opts UserListOptions
+	if err := parseListOptions(queryContext("created_from=2026-01-01&created_to=2026-01-31"), &opts); err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)
+	if opts.CreatedFrom == nil || !opts.CreatedFrom.Equal(from) || opts.CreatedTo == nil || !opts.CreatedTo.Equal(to) {
+		t.Errorf("range = %v to %v, want %v to %v", opts.CreatedFrom, opts.CreatedTo, from, to)
+	}
+	opts = UserListOptions{}
+	if err := parseListOptions(queryContext("created_from=2026-01-01T12:00:00Z"), &opts); err != nil || opts.CreatedTo != nil {
+		t.Errorf("RFC3339 created_from: %v, created_to %v", err, opts.CreatedTo)
+	}
+	for _, query := range []string{
+		"created_from=yesterday",
+		"created_to=2026-02-30",
+		"created_from=2026-02-01&created_to=2026-01-01",
+	} {
+		if err := parseListOptions(queryContext(query), &UserListOptions{}); err == nil {
+			t.Errorf("%s was accepted", query)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// version is the build version, set at link time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+type HealthHandler struct {
+	db *gorm.DB
+}
+
+func NewHealthHandler(db *gorm.DB) *HealthHandler {
+	return &HealthHandler{db: db}
+}
+
+// @Summary Liveness check
+// @Tags health
+// @Produce json
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Router /health [get]
+func (h *HealthHandler) Health(c echo.Context) error {
+	return respondOK(c, http.StatusOK, echo.Map{"status": "ok"}, nil)
+}
+
+// @Summary Readiness check
+// @Tags health
+// @Produce json
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 503 {object} ErrorResponse
+// @Router /readiness [get]
+func (h *HealthHandler) Readiness(c echo.Context) error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return respondError(c, http.StatusServiceUnavailable, err.Error())
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return respondError(c, http.StatusServiceUnavailable, "database unreachable: "+err.Error())
+	}
+	// During a rolling deploy a newer build may already have migrated past
+	// this one, which is fine as long as everything this build needs is there.
+	ok, err := migrationApplied(h.db.WithContext(ctx), latestMigration())
+	if err != nil {
+		return respondError(c, http.StatusServiceUnavailable, "reading migrations failed: "+err.Error())
+	}
+	if !ok {
+		applied, err := appliedMigration(h.db.WithContext(ctx))
+		if err != nil {
+			return respondError(c, http.StatusServiceUnavailable, "reading migrations failed: "+err.Error())
+		}
+		return notReady(c, "database migrations are not applied", echo.Map{
+			"migration_version": applied,
+			"latest_migration":  latestMigration(),
+		})
+	}
+	if !h.db.WithContext(ctx).Migrator().HasTable(&Users{}) {
+		return notReady(c, "users table is missing", nil)
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"status": "ready"}, nil)
+}
+
+// notReady answers 503 with details on what readiness is waiting for.
+func notReady(c echo.Context, msg string, details interface{}) error {
+	return respondErrorDetails(c, http.StatusServiceUnavailable, msg, details)
+}
+
+// @Summary Build and schema versions
+// @Tags health
+// @Produce json
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 503 {object} ErrorResponse
+// @Router /version [get]
+func (h *HealthHandler) Version(c echo.Context) error {
+	applied, err := appliedMigration(h.db.WithContext(c.Request().Context()))
+	if err != nil {
+		return respondError(c, http.StatusServiceUnavailable, "reading migrations failed: "+err.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{
+		"version":           version,
+		"migration_version": applied,
+		"latest_migration":  latestMigration(),
+	}, nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	es_translations "github.com/go-playground/validator/v10/translations/es"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// spanishMessages covers the rules the validator's Spanish translations lack.
+// {0} is the field and {1} the rule's parameter.
+var spanishMessages = map[string]string{
+	"datetime":       "{0} debe ser una fecha con formato AAAA-MM-DD",
+	"strongpassword": "{0} no cumple los requisitos de seguridad de la contraseña",
+	"emaildomain":    "el dominio de {0} no está permitido",
+	"minage":         "{0}: el usuario debe tener al menos {1} años",
+	"timezone":       "{0} debe ser una zona horaria IANA como America/New_York",
+}
+
+// newTranslators registers the localized validation messages on cv's
+// validator. English is the fallback and keeps the messages from
+// fieldErrorMessage.
+func (cv *CustomValidator) newTranslators() (*ut.UniversalTranslator, error) {
+	v := cv.validator
+	uni := ut.New(en.New(), en.New(), es.New())
+	trans, _ := uni.GetTranslator("es")
+	if err := es_translations.RegisterDefaultTranslations(v, trans); err != nil {
+		return nil, err
+	}
+	for tag, text := range spanishMessages {
+		tag, text := tag, text
+		register := func(t ut.Translator) error {
+			return t.Add(tag, text, true)
+		}
+		if err := v.RegisterTranslation(tag, trans, register, cv.translateRule); err != nil {
+			return nil, err
+		}
+	}
+	return uni, nil
+}
+
+func (cv *CustomValidator) translateRule(t ut.Translator, fe validator.FieldError) string {
+	param := fe.Param()
+	if fe.Tag() == "minage" {
+		param = strconv.Itoa(cv.minAge(param))
+	}
+	msg, err := t.T(fe.Tag(), fe.Field(), param)
+	if err != nil {
+		return cv.fieldErrorMessage(fe)
+	}
+	return msg
+}
+
+// acceptedLocales lists the locales of an Accept-Language header, most
+// preferred first. Each region-specific locale is followed by its base
+// language, so "es-MX" also matches "es".
+func acceptedLocales(header string) []string {
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var prefs []preference
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.TrimSpace(params[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if n, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = n
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	locales := make([]string, 0, 2*len(prefs))
+	for _, p := range prefs {
+		locale := strings.ReplaceAll(p.tag, "-", "_")
+		locales = append(locales, locale)
+		if i := strings.Index(locale, "_"); i > 0 {
+			locales = append(locales, locale[:i])
+		}
+	}
+	return locales
+}
+
+// localize rewrites the field messages in the language preferred by an
+// Accept-Language header. Unsupported languages keep the English ones.
+func (e *ValidationError) localize(acceptLanguage string) {
+	if e.translators == nil {
+		return
+	}
+	trans, found := e.translators.FindTranslator(acceptedLocales(acceptLanguage)...)
+	if !found || trans.Locale() == e.translators.GetFallback().Locale() {
+		return
+	}
+	for i, fe := range e.fields {
+		e.Errors[i].Message = fe.Translate(trans)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedLocales(t *testing.T) {
+	for header, want := range map[string][]string{
+		"":                      {},
+		"es":                    {"es"},
+		"es-MX":                 {"es_MX", "es"},
+		"en;q=0.5, es-MX;q=0.9": {"es_MX", "es", "en"},
+		"fr;q=0, *, de;q=bad":   {"de"},
+		" en-GB ; q=0.8 , es ":  {"es", "en_GB", "en"},
+	} {
+		if got := acceptedLocales(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("acceptedLocales(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for header, want := range map[string]string{
+		"es-MX":      "username es un campo requerido",
+		"fr, es;q=0": "username is required",
+		"":           "username is required",
+	} {
+		err := cv.Validate(&UserRequest{Password: "Str0ng-passw0rd", Email: "ana@example.com"})
+		var verr *ValidationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("Validate() = %v, want a *ValidationError", err)
+		}
+		verr.localize(header)
+		if len(verr.Errors) != 1 || !strings.Contains(verr.Errors[0].Message, want) {
+			t.Errorf("Accept-Language %q: errors = %+v, want %q", header, verr.Errors, want)
+		}
+	}
+}
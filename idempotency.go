@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"io"
+	"time"
+)
+
+const headerIdempotencyKey = "Idempotency-Key"
+
+// hashRequestBody hashes the raw request body and puts it back so the
+// handler can still bind it.
+func hashRequestBody(c echo.Context) (string, error) {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	return hashToken(string(body)), nil
+}
+
+// findReplay returns the stored response for key if callerID used it within
+// ttl. An expired record is deleted so the key can be reused.
+func findReplay(tx UserRepository, callerID, key string, ttl time.Duration) (*IdempotencyKey, error) {
+	record, err := tx.FindIdempotencyKey(callerID, key)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(record.CreatedAt) < ttl {
+		return record, nil
+	}
+	return nil, tx.DeleteIdempotencyKey(record)
+}
+
+func recordIdempotencyKey(tx UserRepository, callerID, key, requestHash string, status int, body interface{}) error {
+	response, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return tx.CreateIdempotencyKey(&IdempotencyKey{
+		Key:         key,
+		CallerID:    callerID,
+		RequestHash: requestHash,
+		StatusCode:  status,
+		Response:    response,
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var errImportFailed = errors.New("import failed")
+
+// Import creates users from an uploaded CSV file whose header row names the
+// UserRequest JSON fields. Rows without a password get a random one. Invalid
+// rows are reported and skipped unless ?atomic=true, in which case any failure
+// rolls back the whole import, answering 422 with the failed rows in details.
+// Imported users are sent a verification email, as on create.
+// @Summary Import users from CSV
+// @Tags users
+// @Accept multipart/form-data
+// @Produce json
+// @Security BearerAuth
+// @Param file formData file true "CSV file"
+// @Param atomic query bool false "Roll back the whole import on any failure"
+// @Success 200 {object} SuccessResponse{data=ImportResult}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /users/import [post]
+func (h *UserHandler) Import(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, "file is required")
+	}
+	src, err := file.Open()
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	defer src.Close()
+
+	r := csv.NewReader(src)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, "file must start with a header row")
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	atomic := c.QueryParam("atomic") == "true"
+	result := ImportResult{Failed: []ImportFailure{}}
+	var imported []importedUser
+	errTx := h.users(c).Transaction(func(tx UserRepository) error {
+		for line := 2; ; line++ {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var user importedUser
+			if err == nil {
+				user, err = h.importRow(c, tx, columns, record)
+			}
+			if err != nil {
+				result.Failed = append(result.Failed, ImportFailure{Row: line, Error: errorMessage(err)})
+				if atomic {
+					return errImportFailed
+				}
+				continue
+			}
+			imported = append(imported, user)
+			result.Imported++
+		}
+		return nil
+	})
+	if errTx != nil {
+		if errors.Is(errTx, errImportFailed) {
+			return respondErrorDetails(c, http.StatusUnprocessableEntity, "import rolled back", result.Failed)
+		}
+		return respondError(c, http.StatusInternalServerError, errTx.Error())
+	}
+	for _, u := range imported {
+		h.sendMail(c, u.user, "verification", verificationSubject, u.token)
+	}
+	return respondOK(c, http.StatusOK, result, nil)
+}
+
+// importedUser is a user created by an import, kept with its verification
+// token until the import commits.
+type importedUser struct {
+	user  *Users
+	token string
+}
+
+// importRow validates and inserts a single CSV record inside its own savepoint
+// so a failed insert does not abort the surrounding transaction.
+func (h *UserHandler) importRow(c echo.Context, tx UserRepository, columns map[string]int, record []string) (importedUser, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	request := UserRequest{
+		Username:  normalizeUsername(field("username")),
+		Password:  field("password"),
+		FirstName: field("first_name"),
+		LastName:  field("last_name"),
+		Phone:     normalizePhone(field("phone"), h.cfg.DefaultPhoneCountryCode),
+		Email:     normalizeEmail(field("email")),
+		Birthday:  field("birthday"),
+		Timezone:  field("timezone"),
+	}
+	if request.Password == "" {
+		generated, err := randomToken(importPasswordBytes)
+		if err != nil {
+			return importedUser{}, err
+		}
+		// Prefix guarantees every strength rule is met regardless of the hex.
+		request.Password = "Aa1!" + generated
+	}
+	if err := c.Validate(&request); err != nil {
+		return importedUser{}, err
+	}
+	user, token, err := newUser(request, h.cfg.BcryptCost)
+	if err != nil {
+		return importedUser{}, err
+	}
+	err = tx.Transaction(func(tx UserRepository) error {
+		err := tx.Create(user)
+		if column, ok := uniqueViolationField(err); ok {
+			return errors.New(column + " already exists")
+		}
+		if err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, UserCreated, user.UserID); err != nil {
+			return err
+		}
+		return recordAudit(c, tx, auditCreate, nil, user)
+	})
+	return importedUser{user: user, token: token}, err
+}
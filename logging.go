@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+	"io"
+	"os"
+	"time"
+)
+
+var gormLogLevels = map[string]gormlogger.LogLevel{
+	"silent": gormlogger.Silent,
+	"error":  gormlogger.Error,
+	"warn":   gormlogger.Warn,
+	"info":   gormlogger.Info,
+}
+
+// newGormLogger routes GORM's logging through zap. Queries slower than
+// DB_SLOW_QUERY_THRESHOLD are logged as warnings with their duration, and
+// DB_LOG_LEVEL (silent, error, warn or info; warn when unset) picks what else
+// is logged, info meaning every query.
+func newGormLogger(cfg *Config) gormlogger.Interface {
+	return &gormLogger{
+		log:   zap.L().Named("gorm"),
+		level: gormLogLevels[cfg.DBLogLevel],
+		slow:  cfg.DBSlowQueryThreshold,
+	}
+}
+
+// gormLogger implements GORM's logger interface on zap, writing each query as
+// structured fields rather than GORM's preformatted lines.
+type gormLogger struct {
+	log   *zap.Logger
+	level gormlogger.LogLevel
+	slow  time.Duration
+}
+
+func (l *gormLogger) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *gormLogger) Info(_ context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Info {
+		l.log.Sugar().Infof(msg, args...)
+	}
+}
+
+func (l *gormLogger) Warn(_ context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Warn {
+		l.log.Sugar().Warnf(msg, args...)
+	}
+}
+
+func (l *gormLogger) Error(_ context.Context, msg string, args ...interface{}) {
+	if l.level >= gormlogger.Error {
+		l.log.Sugar().Errorf(msg, args...)
+	}
+}
+
+func (l *gormLogger) Trace(_ context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if l.level <= gormlogger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= gormlogger.Error:
+		sql, rows := fc()
+		l.log.Error("query failed", zap.Error(err), zap.Duration("duration", elapsed), zap.String("sql", sql), zap.Int64("rows", rows))
+	case l.slow > 0 && elapsed > l.slow && l.level >= gormlogger.Warn:
+		sql, rows := fc()
+		l.log.Warn("slow query", zap.Duration("duration", elapsed), zap.Duration("threshold", l.slow), zap.String("sql", sql), zap.Int64("rows", rows))
+	case l.level >= gormlogger.Info:
+		sql, rows := fc()
+		l.log.Info("query", zap.Duration("duration", elapsed), zap.String("sql", sql), zap.Int64("rows", rows))
+	}
+}
+
+// newLogger builds the process logger. LOG_LEVEL picks the minimum level
+// (debug, info, warn or error; info when unset or invalid) and LOG_FORMAT=json
+// switches from human-readable console output to JSON.
+func newLogger() (*zap.Logger, error) {
+	config := zap.NewDevelopmentConfig()
+	if os.Getenv("LOG_FORMAT") == "json" {
+		config = zap.NewProductionConfig()
+	}
+	level := zapcore.InfoLevel
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = zapcore.InfoLevel
+	}
+	config.Level = zap.NewAtomicLevelAt(level)
+	return config.Build()
+}
+
+// requestLogger logs one structured line per request. It also gives each
+// request a logger tagged with its request ID, so c.Logger() output in
+// handlers can be correlated with the request line.
+func requestLogger() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		LogMethod:    true,
+		LogURIPath:   true,
+		LogStatus:    true,
+		LogLatency:   true,
+		LogRequestID: true,
+		BeforeNextFunc: func(c echo.Context) {
+			c.SetLogger(newEchoLogger(zap.S().With("request_id", requestID(c))))
+		},
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			zap.L().Info("request",
+				zap.String("method", v.Method),
+				zap.String("path", v.URIPath),
+				zap.Int("status", v.Status),
+				zap.Duration("latency", v.Latency),
+				zap.String("request_id", v.RequestID),
+			)
+			return nil
+		},
+	})
+}
+
+// echoLogger adapts a zap logger to the echo.Logger interface so Echo and
+// c.Logger() write through zap.
+type echoLogger struct {
+	*zap.SugaredLogger
+	prefix string
+}
+
+func newEchoLogger(l *zap.SugaredLogger) *echoLogger {
+	return &echoLogger{SugaredLogger: l}
+}
+
+func (l *echoLogger) Output() io.Writer                         { return os.Stdout }
+func (l *echoLogger) SetOutput(io.Writer)                       {}
+func (l *echoLogger) Prefix() string                            { return l.prefix }
+func (l *echoLogger) SetPrefix(p string)                        { l.prefix = p }
+func (l *echoLogger) SetLevel(log.Lvl)                          {}
+func (l *echoLogger) SetHeader(string)                          {}
+func (l *echoLogger) Print(i ...interface{})                    { l.Info(i...) }
+func (l *echoLogger) Printf(format string, args ...interface{}) { l.Infof(format, args...) }
+func (l *echoLogger) Printj(j log.JSON)                         { l.Infoj(j) }
+func (l *echoLogger) Debugj(j log.JSON)                         { l.Debugw("", fieldsOf(j)...) }
+func (l *echoLogger) Infoj(j log.JSON)                          { l.Infow("", fieldsOf(j)...) }
+func (l *echoLogger) Warnj(j log.JSON)                          { l.Warnw("", fieldsOf(j)...) }
+func (l *echoLogger) Errorj(j log.JSON)                         { l.Errorw("", fieldsOf(j)...) }
+func (l *echoLogger) Fatalj(j log.JSON)                         { l.Fatalw("", fieldsOf(j)...) }
+func (l *echoLogger) Panicj(j log.JSON)                         { l.Panicw("", fieldsOf(j)...) }
+
+func (l *echoLogger) Level() log.Lvl {
+	switch {
+	case l.Desugar().Core().Enabled(zapcore.DebugLevel):
+		return log.DEBUG
+	case l.Desugar().Core().Enabled(zapcore.InfoLevel):
+		return log.INFO
+	case l.Desugar().Core().Enabled(zapcore.WarnLevel):
+		return log.WARN
+	case l.Desugar().Core().Enabled(zapcore.ErrorLevel):
+		return log.ERROR
+	}
+	return log.OFF
+}
+
+func fieldsOf(j log.JSON) []interface{} {
+	fields := make([]interface{}, 0, 2*len(j))
+	for k, v := range j {
+		fields = append(fields, k, v)
+	}
+	return fields
+}
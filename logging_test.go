@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewLoggerLevel(t *testing.T) {
+	for raw, want := range map[string]zapcore.Level{
+		"":      zapcore.InfoLevel,
+		"debug": zapcore.DebugLevel,
+		"warn":  zapcore.WarnLevel,
+		"error": zapcore.ErrorLevel,
+		"loud":  zapcore.InfoLevel,
+	} {
+		t.Setenv("LOG_LEVEL", raw)
+		logger, err := newLogger()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !logger.Core().Enabled(want) || (want > zapcore.DebugLevel && logger.Core().Enabled(want-1)) {
+			t.Errorf("LOG_LEVEL=%q: logger does not start at %s", raw, want)
+		}
+	}
+}
+
+// observeLogs routes the global logger to an in-memory core for the rest of t.
+func observeLogs(t *testing.T, level zapcore.Level) *observer.ObservedLogs {
+	core, logs := observer.New(level)
+	t.Cleanup(zap.ReplaceGlobals(zap.New(core)))
+	return logs
+}
+
+func TestRequestLoggerIncludesRequestID(t *testing.T) {
+	logs := observeLogs(t, zapcore.InfoLevel)
+	e := echo.New()
+	e.Use(middleware.RequestID(), requestLogger())
+	e.GET("/", func(c echo.Context) error {
+		c.Logger().Info("handling")
+		return c.NoContent(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-42")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, msg := range []string{"handling", "request"} {
+		entries := logs.FilterMessage(msg).FilterField(zap.String("request_id", "req-42")).All()
+		if len(entries) != 1 {
+			t.Errorf("%d %q entries with the request ID, want 1; logged %v", len(entries), msg, logs.All())
+		}
+	}
+}
+
+func TestGormLoggerSlowQueries(t *testing.T) {
+	logs := observeLogs(t, zapcore.DebugLevel)
+	l := newGormLogger(&Config{DBLogLevel: "warn", DBSlowQueryThreshold: 100 * time.Millisecond})
+	query := func() (string, int64) { return "SELECT 1", 1 }
+
+	l.Trace(context.Background(), time.Now().Add(-10*time.Millisecond), query, nil)
+	if logs.Len() != 0 {
+		t.Fatalf("a fast query was logged at warn level: %v", logs.All())
+	}
+	l.Trace(context.Background(), time.Now().Add(-200*time.Millisecond), query, nil)
+	slow := logs.FilterMessage("slow query").FilterField(zap.String("sql", "SELECT 1")).All()
+	if len(slow) != 1 || slow[0].Level != zapcore.WarnLevel {
+		t.Errorf("logged %v, want one slow query warning", logs.All())
+	}
+	l.Trace(context.Background(), time.Now(), query, gorm.ErrRecordNotFound)
+	l.Trace(context.Background(), time.Now(), query, errors.New("boom"))
+	if failed := logs.FilterMessage("query failed").All(); len(failed) != 1 {
+		t.Errorf("logged %d failed queries, want only the real error", len(failed))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	verificationSubject  = "Verify your account"
+	passwordResetSubject = "Reset your password"
+)
+
+// Default email bodies. MAIL_TEMPLATE_DIR can override either one with a
+// verification.tmpl or password_reset.tmpl file of its own.
+var defaultMailTemplates = map[string]string{
+	"verification": `Hi {{.Username}},
+
+Confirm your email address by opening:
+{{.BaseURL}}/users/verify?token={{.Token}}
+`,
+	"password_reset": `Hi {{.Username}},
+
+Use this token to reset your password:
+{{.Token}}
+
+If you did not ask for a reset, you can ignore this email.
+`,
+}
+
+type (
+	// Mailer delivers a plain-text email.
+	Mailer interface {
+		Send(to, subject, body string) error
+	}
+
+	// logMailer writes emails to the log instead of sending them, for
+	// development.
+	logMailer struct{}
+
+	// mailQueue hands emails to a background goroutine that sends them through
+	// next. Requests never wait on the mail server, so a response's timing
+	// does not reveal whether it sent an email. Close waits for the emails
+	// already queued.
+	mailQueue struct {
+		next   Mailer
+		queue  chan queuedMail
+		done   chan struct{}
+		mu     sync.RWMutex
+		closed bool
+	}
+
+	queuedMail struct {
+		to, subject, body string
+	}
+
+	smtpMailer struct {
+		addr string
+		from string
+		auth smtp.Auth
+	}
+
+	mailData struct {
+		Username string
+		Token    string
+		BaseURL  string
+	}
+)
+
+// newMailer sends through SMTP_HOST when it is set and logs emails otherwise.
+func newMailer(cfg *Config) Mailer {
+	if cfg.SMTPHost == "" {
+		return logMailer{}
+	}
+	m := &smtpMailer{addr: cfg.SMTPHost + ":" + cfg.SMTPPort, from: cfg.SMTPFrom}
+	if cfg.SMTPUsername != "" {
+		m.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return m
+}
+
+var (
+	errMailQueueFull   = errors.New("mail queue is full")
+	errMailQueueClosed = errors.New("mail queue is closed")
+)
+
+func newMailQueue(next Mailer, size int) *mailQueue {
+	q := &mailQueue{next: next, queue: make(chan queuedMail, size), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *mailQueue) run() {
+	defer close(q.done)
+	for m := range q.queue {
+		if err := q.next.Send(m.to, m.subject, m.body); err != nil {
+			zap.L().Error("sending email", zap.String("subject", m.subject), zap.Error(err))
+		}
+	}
+}
+
+// Send queues the email, failing when the queue is full or closed.
+func (q *mailQueue) Send(to, subject, body string) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errMailQueueClosed
+	}
+	select {
+	case q.queue <- queuedMail{to: to, subject: subject, body: body}:
+		return nil
+	default:
+		return errMailQueueFull
+	}
+}
+
+// Close stops accepting emails and waits for the queued ones to be sent.
+func (q *mailQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+func (logMailer) Send(to, subject, body string) error {
+	zap.L().Info("email", zap.String("to", to), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.from, to, subject, strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+// renderMail fills in the named email template, preferring a file in dir
+// (MAIL_TEMPLATE_DIR) over the built-in default.
+func renderMail(dir, name string, data mailData) (string, error) {
+	text := defaultMailTemplates[name]
+	if dir != "" {
+		if custom, err := os.ReadFile(filepath.Join(dir, name+".tmpl")); err == nil {
+			text = string(custom)
+		}
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return "", err
+	}
+	return body.String(), nil
+}
+
+// sendMail renders the named email and queues it for user. The action that
+// triggered it has already succeeded, so failures are only logged.
+func (h *UserHandler) sendMail(c echo.Context, user *Users, name, subject, token string) {
+	body, err := renderMail(h.cfg.MailTemplateDir, name, mailData{Username: user.Username, Token: token, BaseURL: h.cfg.AppBaseURL})
+	if err == nil {
+		err = h.mailer.Send(user.Email, subject, body)
+	}
+	if err != nil {
+		c.Logger().Errorf("sending %s email to user %d: %v", name, user.UserID, err)
+	}
+}
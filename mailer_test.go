@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingMailer keeps the subjects of the emails it is given.
+type recordingMailer struct {
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subjects = append(m.subjects, subject)
+	return nil
+}
+
+func TestMailQueue(t *testing.T) {
+	next := &recordingMailer{}
+	q := newMailQueue(next, 2)
+	for _, subject := range []string{"one", "two"} {
+		if err := q.Send("user@example.com", subject, "body"); err != nil {
+			t.Fatalf("Send(%q) = %v", subject, err)
+		}
+	}
+	q.Close()
+	if len(next.subjects) != 2 || next.subjects[0] != "one" || next.subjects[1] != "two" {
+		t.Errorf("sent %v, want [one two]", next.subjects)
+	}
+	if err := q.Send("user@example.com", "three", "body"); !errors.Is(err, errMailQueueClosed) {
+		t.Errorf("Send after Close = %v, want %v", err, errMailQueueClosed)
+	}
+}
+
+func TestNewMailer(t *testing.T) {
+	if _, ok := newMailer(&Config{}).(logMailer); !ok {
+		t.Error("without SMTP_HOST, newMailer() is not the log mailer")
+	}
+	m, ok := newMailer(&Config{SMTPHost: "smtp.example.com", SMTPPort: "587", SMTPFrom: "ums@example.com"}).(*smtpMailer)
+	if !ok || m.addr != "smtp.example.com:587" || m.auth != nil {
+		t.Errorf("newMailer() = %+v, want an SMTP mailer for smtp.example.com:587 without auth", m)
+	}
+}
+
+func TestRenderMail(t *testing.T) {
+	data := mailData{Username: "alice", Token: "tok123", BaseURL: "https://ums.example"}
+	body, err := renderMail("", "verification", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "Hi alice") || !strings.Contains(body, "https://ums.example/users/verify?token=tok123") {
+		t.Errorf("verification email = %q, want the greeting and link", body)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "verification.tmpl"), []byte("Welcome {{.Username}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := renderMail(dir, "verification", data); err != nil || body != "Welcome alice" {
+		t.Errorf("custom verification email = %q, %v; want the template from MAIL_TEMPLATE_DIR", body, err)
+	}
+	if body, err := renderMail(dir, "password_reset", data); err != nil || !strings.Contains(body, "tok123") {
+		t.Errorf("password_reset email = %q, %v; want the built-in template", body, err)
+	}
+}
@@ -1,186 +1,555 @@
 package main
 
+//go:generate swag init -g main.go
+
 import (
+	"context"
 	"errors"
+	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/postgres"
+	"github.com/labstack/echo/v4/middleware"
+	echoSwagger "github.com/swaggo/echo-swagger"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "ums/docs"
+)
+
+const (
+	defaultPage        = 1
+	defaultPageSize    = 20
+	defaultMaxPageSize = 100
+	maxBatchIDs        = 100
+
+	defaultPasswordMinLength   = 8
+	defaultPhoneCountryCode    = "62"
+	defaultMinAge              = 13
+	defaultTimezone            = "UTC"
+	defaultPasswordHistorySize = 5
+	minMFAKeyLength            = 32
+	verificationTokenBytes     = 32
+	refreshTokenBytes          = 32
+	resetTokenBytes            = 32
+	importPasswordBytes        = 12
+	avatarNameBytes            = 16
+	maxAvatarBytes             = 2 << 20
+	// avatarBodyLimit leaves room for the multipart framing around the file.
+	avatarBodyLimit     = "3M"
+	defaultSeedUsers    = 50
+	defaultSeedPassword = "Seed-passw0rd"
+	seedBatchSize       = 100
+
+	defaultAddr            = ":8080"
+	defaultAvatarDir       = "uploads/avatars"
+	defaultMetricsPath     = "/metrics"
+	defaultSMTPPort        = "587"
+	mailQueueSize          = 100
+	defaultRequestTimeout  = 30 * time.Second
+	defaultGzipLevel       = -1
+	defaultBodyLimit       = "1M"
+	defaultImportBodyLimit = "10M"
+	gzipMinLength          = 1024
+	shutdownTimeout        = 10 * time.Second
+
+	defaultAccessTokenTTL    = 15 * time.Minute
+	defaultRefreshTokenTTL   = 7 * 24 * time.Hour
+	defaultPasswordResetTTL  = time.Hour
+	defaultIdempotencyKeyTTL = 24 * time.Hour
+	defaultPhoneOTPTTL       = 10 * time.Minute
+	maxPhoneOTPAttempts      = 5
+	mfaQRCodeSize            = 200
+
+	defaultConnectRetries     = 5
+	defaultConnectBackoff     = time.Second
+	defaultMaxOpenConns       = 25
+	defaultMaxIdleConns       = 10
+	defaultConnMaxLifetime    = 30 * time.Minute
+	defaultSlowQueryThreshold = 200 * time.Millisecond
+	defaultDBLogLevel         = "warn"
+
+	tracingServiceName            = "ums"
+	defaultMetricsRefreshInterval = 30 * time.Second
+	eventBufferSize               = 256
+	defaultOutboxPollInterval     = time.Second
+	outboxBatchSize               = 100
+
+	defaultWebhookPollInterval = 5 * time.Second
+	webhookBatchSize           = 20
+	webhookTimeout             = 10 * time.Second
+	// webhookLease is how long a claimed delivery stays hidden from other
+	// instances before it is considered abandoned and sent again.
+	webhookLease = 5 * time.Minute
+	// A failing delivery is retried after webhookRetryBackoff, doubling each
+	// time, until webhookMaxAttempts have failed.
+	webhookRetryBackoff    = 30 * time.Second
+	webhookMaxAttempts     = 8
+	webhookDeliveriesShown = 50
+
+	defaultLoginRateLimit    = 5
+	defaultLoginRateWindow   = time.Minute
+	defaultExistsRateLimit   = 20
+	defaultExistsRateWindow  = time.Minute
+	defaultProfileRateLimit  = 10
+	defaultProfileRateWindow = time.Minute
+	defaultResetRateLimit    = 5
+	defaultResetRateWindow   = 15 * time.Minute
+	defaultPhoneRateLimit    = 3
+	defaultPhoneRateWindow   = 15 * time.Minute
+	defaultMaxFailedLogins   = 5
+	defaultLockoutDuration   = 15 * time.Minute
+
+	roleUser  = "user"
+	roleAdmin = "admin"
 )
 
 type (
 	Users struct {
-		UserID    int       `json:"user_id" gorm:"primaryKey;autoIncrement"`
-		Username  string    `json:"username" gorm:"unique"`
-		Password  string    `json:"password"`
-		FirstName string    `json:"first_name"`
-		LastName  string    `json:"last_name"`
-		Phone     string    `json:"phone" gorm:"unique"`
-		Email     string    `json:"email" gorm:"unique"`
-		Birthday  time.Time `json:"birthday"`
-		IsActive  bool      `json:"is_active" gorm:"default:false"`
+		UserID                int            `json:"user_id" gorm:"primaryKey;autoIncrement"`
+		Username              string         `json:"username" gorm:"uniqueIndex:idx_users_username"`
+		Password              string         `json:"-"`
+		FirstName             string         `json:"first_name"`
+		LastName              string         `json:"last_name"`
+		Phone                 *string        `json:"phone" gorm:"uniqueIndex:idx_users_phone"`
+		Email                 string         `json:"email" gorm:"uniqueIndex:idx_users_email"`
+		PhoneVerified         bool           `json:"phone_verified" gorm:"default:false"`
+		PhoneOTPHash          *string        `json:"-"`
+		PhoneOTPExpiresAt     *time.Time     `json:"-"`
+		PhoneOTPAttempts      int            `json:"-" gorm:"default:0"`
+		MFAEnabled            bool           `json:"mfa_enabled" gorm:"default:false"`
+		MFASecret             *string        `json:"-"`
+		MFALastStep           *int64         `json:"-"`
+		Birthday              *time.Time     `json:"birthday"`
+		Timezone              string         `json:"timezone" gorm:"not null;default:UTC"`
+		IsActive              bool           `json:"is_active" gorm:"default:false"`
+		Role                  string         `json:"role" gorm:"default:user"`
+		VerificationTokenHash *string        `json:"-" gorm:"index"`
+		FailedLoginCount      int            `json:"-" gorm:"default:0"`
+		LockedUntil           *time.Time     `json:"-"`
+		LastLoginAt           *time.Time     `json:"last_login_at"`
+		AvatarURL             *string        `json:"avatar_url"`
+		CreatedAt             time.Time      `json:"created_at"`
+		UpdatedAt             time.Time      `json:"updated_at"`
+		Version               int            `json:"version" gorm:"default:0"`
+		DeletedAt             gorm.DeletedAt `json:"-" gorm:"index"`
+	}
+	UserAudit struct {
+		ID        int          `json:"id" gorm:"primaryKey;autoIncrement"`
+		UserID    int          `json:"user_id" gorm:"index"`
+		ActorID   *int         `json:"actor_id"`
+		Action    string       `json:"action"`
+		Changes   AuditChanges `json:"changes" gorm:"type:jsonb" swaggertype:"object"`
+		CreatedAt time.Time    `json:"created_at"`
+	}
+	PasswordResetToken struct {
+		ID        int        `json:"id" gorm:"primaryKey;autoIncrement"`
+		TokenHash string     `json:"-" gorm:"uniqueIndex"`
+		UserID    int        `json:"user_id" gorm:"index"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		UsedAt    *time.Time `json:"used_at"`
+		CreatedAt time.Time  `json:"created_at"`
+	}
+	OutboxEvent struct {
+		ID          int        `json:"id" gorm:"primaryKey;autoIncrement"`
+		Type        EventType  `json:"type"`
+		UserID      int        `json:"user_id"`
+		OccurredAt  time.Time  `json:"occurred_at"`
+		PublishedAt *time.Time `json:"published_at" gorm:"index"`
+	}
+	Webhook struct {
+		ID        int        `json:"id" gorm:"primaryKey;autoIncrement"`
+		URL       string     `json:"url"`
+		Secret    string     `json:"-"`
+		Events    EventTypes `json:"events" gorm:"type:jsonb" swaggertype:"array,string"`
+		Active    bool       `json:"active" gorm:"default:true"`
+		CreatedAt time.Time  `json:"created_at"`
+		UpdatedAt time.Time  `json:"updated_at"`
+	}
+	// WebhookDelivery is one event queued for one webhook. It is pending until
+	// DeliveredAt is set, or FailedAt once it has run out of attempts.
+	WebhookDelivery struct {
+		ID            int        `json:"id" gorm:"primaryKey;autoIncrement"`
+		WebhookID     int        `json:"webhook_id" gorm:"index"`
+		Webhook       Webhook    `json:"-" gorm:"constraint:OnDelete:CASCADE"`
+		EventType     EventType  `json:"event_type"`
+		UserID        int        `json:"user_id"`
+		OccurredAt    time.Time  `json:"occurred_at"`
+		Attempts      int        `json:"attempts" gorm:"default:0"`
+		NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+		LastError     string     `json:"last_error,omitempty"`
+		DeliveredAt   *time.Time `json:"delivered_at"`
+		FailedAt      *time.Time `json:"failed_at"`
+		CreatedAt     time.Time  `json:"created_at"`
+	}
+	PasswordHistory struct {
+		ID           int       `json:"id" gorm:"primaryKey;autoIncrement"`
+		UserID       int       `json:"user_id" gorm:"index"`
+		PasswordHash string    `json:"-"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+	IdempotencyKey struct {
+		ID          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+		Key         string    `json:"key" gorm:"uniqueIndex:idx_idempotency_caller_key"`
+		CallerID    string    `json:"caller_id" gorm:"uniqueIndex:idx_idempotency_caller_key"`
+		RequestHash string    `json:"-"`
+		StatusCode  int       `json:"status_code"`
+		Response    []byte    `json:"-"`
+		CreatedAt   time.Time `json:"created_at"`
+	}
+	RefreshToken struct {
+		ID        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+		TokenHash string    `json:"-" gorm:"uniqueIndex"`
+		UserID    int       `json:"user_id" gorm:"index"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Revoked   bool      `json:"revoked" gorm:"default:false"`
+		UserAgent string    `json:"user_agent"`
+		IP        string    `json:"ip"`
+		CreatedAt time.Time `json:"created_at"`
 	}
 	UserRequest struct {
 		Username  string `json:"username" validate:"required"`
-		Password  string `json:"password" validate:"required"`
+		Password  string `json:"password" validate:"required,strongpassword"`
 		FirstName string `json:"first_name"`
 		LastName  string `json:"last_name"`
-		Phone     string `json:"phone" validate:"required"`
-		Email     string `json:"email" validate:"required,email"`
-		Birthday  string `json:"birthday" validate:"omitempty,datetime=2006-01-02"`
+		Phone     string `json:"phone" validate:"omitempty,e164"`
+		Email     string `json:"email" validate:"required,email,emaildomain"`
+		Birthday  string `json:"birthday" validate:"omitempty,datetime=2006-01-02,minage"`
+		Timezone  string `json:"timezone" validate:"omitempty,timezone"`
+		Version   *int   `json:"version,omitempty"`
 	}
+	// UserEditRequest is a partial update: omitted fields are left alone,
+	// while an empty first_name, last_name, phone or birthday clears it and an
+	// empty timezone resets it to UTC.
 	UserEditRequest struct {
-		Username  string `json:"username"`
-		Password  string `json:"password"`
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-		Phone     string `json:"phone"`
-		Email     string `json:"email" validate:"omitempty,email"`
-		Birthday  string `json:"birthday" validate:"omitempty,datetime=2006-01-02"`
+		Username  *string `json:"username" validate:"omitempty,min=1"`
+		Password  *string `json:"password" validate:"omitempty,strongpassword"`
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Phone     *string `json:"phone" validate:"omitempty,e164"`
+		Email     *string `json:"email" validate:"omitempty,email,emaildomain"`
+		Birthday  *string `json:"birthday" validate:"omitempty,datetime=2006-01-02,minage"`
+		Timezone  *string `json:"timezone" validate:"omitempty,timezone"`
+		Version   *int    `json:"version,omitempty"`
+	}
+	// BulkUpdateRequest applies Patch to every listed user. Only the fields
+	// of BulkUserPatch can be changed this way.
+	BulkUpdateRequest struct {
+		IDs   []int         `json:"ids"`
+		Patch BulkUserPatch `json:"patch"`
+	}
+	BulkUserPatch struct {
+		IsActive *bool   `json:"is_active"`
+		Role     *string `json:"role" validate:"omitempty,oneof=user admin"`
+	}
+	// WebhookRequest registers a webhook. Deliveries are signed with Secret,
+	// and the webhook starts active unless Active is false.
+	WebhookRequest struct {
+		URL    string      `json:"url" validate:"required,url"`
+		Secret string      `json:"secret" validate:"required,min=16"`
+		Events []EventType `json:"events" validate:"required,min=1,dive,oneof=user.created user.updated user.deleted user.restored"`
+		Active *bool       `json:"active"`
+	}
+	ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required,strongpassword"`
+	}
+
+	PasswordResetRequest struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	PasswordResetConfirmRequest struct {
+		Token       string `json:"token" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required,strongpassword"`
+	}
+
+	PhoneVerificationRequest struct {
+		Code string `json:"code" validate:"required,len=6,numeric"`
+	}
+	MFACodeRequest struct {
+		Code string `json:"code" validate:"required,len=6,numeric"`
+	}
+	MFAEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+		// QRCode is a base64-encoded PNG of URI.
+		QRCode string `json:"qr_code"`
+	}
+
+	RefreshRequest struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	LoginRequest struct {
+		Username string `json:"username" validate:"required"`
+		Password string `json:"password" validate:"required"`
+		// MFACode is required once the account has MFA enabled.
+		MFACode string `json:"mfa_code,omitempty" validate:"omitempty,len=6,numeric"`
+	}
+
+	JwtClaims struct {
+		UserID   int    `json:"user_id"`
+		Username string `json:"username"`
+		Role     string `json:"role"`
+		jwt.RegisteredClaims
+	}
+
+	ImportFailure struct {
+		Row   int    `json:"row"`
+		Error string `json:"error"`
+	}
+	ImportResult struct {
+		Imported int             `json:"imported"`
+		Failed   []ImportFailure `json:"failed"`
+	}
+
+	ErrorResponse struct {
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+		Details   any    `json:"details,omitempty"`
+		RequestID string `json:"request_id,omitempty"`
 	}
 
 	CustomValidator struct {
-		validator *validator.Validate
+		validator   *validator.Validate
+		translators *ut.UniversalTranslator
+		cfg         *Config
 	}
 )
 
+// @title UMS API
+// @version 1.0
+// @description User management service.
+// @BasePath /
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
 func main() {
 	godotenv.Load(".env")
-	e := echo.New()
-	dsn := os.Getenv("DB_DSN")
-	db, err := gorm.Open(postgres.Open(dsn))
+	logger, err := newLogger()
 	if err != nil {
 		panic(err)
 	}
-	db.AutoMigrate(&Users{})
-
-	e.Validator = &CustomValidator{validator: validator.New()}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
 
-	e.GET("/users", func(c echo.Context) error {
-		var res []Users
-		err := db.Find(&res).Error
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		return c.JSON(http.StatusOK, res)
-	})
-	e.GET("/users/:id", func(c echo.Context) error {
-		var res Users
-		userID := c.Param("id")
-		err := db.Model(&Users{}).First(&res, userID).Error
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.JSON(http.StatusNoContent, "")
-			}
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		return c.JSON(http.StatusOK, res)
-	})
-	e.POST("/users", func(c echo.Context) error {
-		var request UserRequest
-		if err := c.Bind(&request); err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		if err := c.Validate(&request); err != nil {
-			return err
+	cfg, err := loadConfig()
+	if err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		logger.Fatal("setting up tracing", zap.Error(err))
+	}
+	db, err := connectDB(cfg)
+	if err != nil {
+		panic(err)
+	}
+	if err := configurePool(db, cfg); err != nil {
+		panic(err)
+	}
+	if err := traceQueries(db); err != nil {
+		panic(err)
+	}
+	if cfg.RunMigrations {
+		if err := migrate(db); err != nil {
+			panic(err)
 		}
-		crypted, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	if err := checkMFAKey(db, cfg); err != nil {
+		logger.Fatal("invalid configuration", zap.Error(err))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := runSeed(db, cfg.BcryptCost, os.Args[2:]); err != nil {
+			logger.Fatal("seed failed", zap.Error(err))
 		}
+		return
+	}
 
-		birthday, err := time.Parse("2006-01-02", request.Birthday)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		newData := Users{
-			Username:  request.Username,
-			Password:  string(crypted),
-			FirstName: request.FirstName,
-			LastName:  request.LastName,
-			Phone:     request.Phone,
-			Email:     request.Email,
-			Birthday:  birthday,
-		}
-		errCreated := db.Create(&newData).Error
-		if errCreated != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		return c.JSON(http.StatusCreated, newData)
-	})
-	e.PATCH("/users/:id", func(c echo.Context) error {
-		var request UserEditRequest
-		if err := c.Bind(&request); err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		var old Users
-		userID := c.Param("id")
-		err := db.Model(&Users{}).First(&old, userID).Error
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.JSON(http.StatusNoContent, "")
+	var events EventPublisher = noopPublisher{}
+	if cfg.EventPublisher == "channel" {
+		ch := NewChannelPublisher(eventBufferSize)
+		// Nothing consumes events in-process yet, so log them.
+		go func() {
+			for event := range ch.Events() {
+				logger.Info("event",
+					zap.String("type", string(event.Type)),
+					zap.Int("user_id", event.UserID),
+					zap.Time("occurred_at", event.OccurredAt),
+				)
 			}
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
+		}()
+		events = ch
+	}
+	webhooks := NewWebhookRepository(db)
+	events = fanOutPublisher{events, NewWebhookPublisher(webhooks)}
 
-		if request.Email != "" {
-			old.Email = request.Email
-		}
-		if request.Password != "" {
-			crypted, _ := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
-			old.Password = string(crypted)
-		}
-		if request.FirstName != "" {
-			old.FirstName = request.FirstName
-		}
-		if request.LastName != "" {
-			old.LastName = request.LastName
-		}
-		if request.Username != "" {
-			old.Username = request.Username
-		}
-		if request.Birthday != "" {
-			birthday, _ := time.Parse("2006-01-02", request.Birthday)
-			old.Birthday = birthday
+	mailer := newMailQueue(newMailer(cfg), mailQueueSize)
+	e := newServer(cfg, db, mailer, logSMSSender{})
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	go refreshUserCount(workerCtx, db, cfg.MetricsRefreshInterval)
+	go relayOutbox(workerCtx, NewOutboxRepository(db), events, cfg.OutboxPollInterval)
+	go deliverWebhooks(workerCtx, webhooks, cfg.WebhookPollInterval)
+
+	logger.Info("starting server", zap.String("addr", cfg.Addr), zap.Bool("tls", cfg.UseTLS()))
+	go func() {
+		start := func() error { return e.Start(cfg.Addr) }
+		if cfg.UseTLS() {
+			start = func() error { return e.StartTLS(cfg.Addr, cfg.TLSCertFile, cfg.TLSKeyFile) }
 		}
-		if request.Phone != "" {
-			old.Phone = request.Phone
+		if err := start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal("server failed", zap.Error(err))
 		}
+	}()
 
-		errUpdate := db.Updates(&old).Error
-		if errUpdate != nil {
-			return c.JSON(http.StatusInternalServerError, errUpdate.Error)
-		}
-		return c.JSON(http.StatusOK, old)
-	})
-	e.DELETE("/users/:id", func(c echo.Context) error {
-		var res Users
-		userID := c.Param("id")
-		err := db.Model(&Users{}).First(&res, userID).Error
-		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				return c.JSON(http.StatusNoContent, "")
+	// With TLS on, TLS_REDIRECT_ADDR serves plain HTTP that only redirects to
+	// the same host over HTTPS.
+	var redirect *echo.Echo
+	if cfg.UseTLS() && cfg.TLSRedirectAddr != "" {
+		redirect = echo.New()
+		redirect.HideBanner = true
+		redirect.HidePort = true
+		redirect.Pre(middleware.HTTPSRedirect())
+		go func() {
+			if err := redirect.Start(cfg.TLSRedirectAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("redirect server failed", zap.Error(err))
 			}
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		errDel := db.Delete(&res)
-		if errDel != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
-		}
-		return c.JSON(http.StatusOK, res)
-	})
+		}()
+	}
 
-	e.Logger.Fatal(e.Start(":8080"))
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("shutting down server")
+	stopWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		logger.Error("shutdown failed", zap.Error(err))
+	}
+	mailer.Close()
+	if redirect != nil {
+		redirect.Shutdown(ctx)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("flushing traces failed", zap.Error(err))
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	logger.Info("server stopped")
 }
 
-func (cv *CustomValidator) Validate(i interface{}) error {
-	if err := cv.validator.Struct(i); err != nil {
-		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+// newServer builds the Echo instance with all middleware and routes wired to
+// db and the given email and SMS transports, ready to Start or to drive with
+// httptest. Events go through the outbox in db, relayed by relayOutbox.
+func newServer(cfg *Config, db *gorm.DB, mailer Mailer, sms SMSSender) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Logger = newEchoLogger(zap.S())
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(middleware.RequestID())
+	e.Use(traceRequests(cfg.MetricsPath))
+	e.Use(requestLogger())
+	e.Use(middleware.Recover())
+	e.Use(cors(cfg))
+	e.Use(requestTimeout(cfg.RequestTimeout))
+	// Upload routes set their own, larger limits.
+	e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Limit: cfg.BodyLimit,
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/users/import" || c.Path() == "/users/:id/avatar"
+		},
+	}))
+	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+		Level:     cfg.GzipLevel,
+		MinLength: gzipMinLength,
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == cfg.MetricsPath
+		},
+	}))
+	setupMetrics(e, cfg.MetricsPath)
+	e.Use(numericIDs)
+
+	cv, err := newValidator(cfg)
+	if err != nil {
+		panic(err)
+	}
+	e.Validator = cv
+
+	jwtAuth := newJWTAuth(cfg.JWTSecret)
+	profileLimit := profileRateLimiter(cfg)
+	h := NewUserHandler(cfg, NewUserRepository(db), NewRefreshTokenRepository(db), NewPasswordResetRepository(db), mailer, sms)
+
+	// Single-user reads stay public. Changing a user is limited to that user
+	// and admins, and listing, batch reads, deleting or restoring users to
+	// admins.
+	users := e.Group("/users")
+	users.GET("", h.List, jwtAuth, RequireRole(roleAdmin))
+	users.GET("/search", h.Search, jwtAuth, RequireRole(roleAdmin))
+	users.GET("/verify", h.Verify)
+	users.GET("/export", h.Export, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/import", h.Import, middleware.BodyLimit(cfg.ImportBodyLimit), jwtAuth, RequireRole(roleAdmin))
+	users.GET("/batch", h.Batch, jwtAuth, RequireRole(roleAdmin))
+	users.GET("/exists", h.Exists, existsRateLimiter(cfg))
+	if cfg.UserCountPublic {
+		users.GET("/count", h.Count)
+	} else {
+		users.GET("/count", h.Count, jwtAuth, RequireRole(roleAdmin))
 	}
-	return nil
+	users.GET("/:id", h.Get)
+	users.POST("", h.Create, jwtAuth)
+	users.PUT("/:id", h.Replace, jwtAuth, RequireSelfOrAdmin)
+	users.PATCH("/bulk", h.BulkUpdate, jwtAuth, RequireRole(roleAdmin))
+	users.PATCH("/:id", h.Update, jwtAuth, RequireSelfOrAdmin)
+	users.DELETE("/inactive", h.DeleteInactive, jwtAuth, RequireRole(roleAdmin))
+	users.DELETE("/:id", h.Delete, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/:id/deactivate", h.Deactivate, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/:id/activate", h.Activate, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/:id/restore", h.Restore, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/:id/change-password", h.ChangePassword, jwtAuth, RequireSelfOrAdmin, profileLimit)
+	users.GET("/:id/audit", h.Audit, jwtAuth, RequireRole(roleAdmin))
+	users.POST("/:id/avatar", h.UploadAvatar, middleware.BodyLimit(avatarBodyLimit), jwtAuth, RequireSelfOrAdmin)
+	users.DELETE("/:id/avatar", h.DeleteAvatar, jwtAuth, RequireSelfOrAdmin)
+	e.Static(avatarURLPrefix, cfg.AvatarDir)
+
+	e.GET("/me", h.Me, jwtAuth)
+	e.PATCH("/me", h.UpdateMe, jwtAuth, profileLimit)
+	e.GET("/me/sessions", h.ListSessions, jwtAuth)
+	e.DELETE("/me/sessions/:id", h.RevokeSession, jwtAuth)
+	e.POST("/me/phone/verify/request", h.RequestPhoneVerification, jwtAuth, phoneRateLimiter(cfg))
+	e.POST("/me/phone/verify/confirm", h.ConfirmPhoneVerification, jwtAuth)
+	e.POST("/me/mfa/enroll", h.EnrollMFA, jwtAuth)
+	e.POST("/me/mfa/verify", h.VerifyMFA, jwtAuth)
+
+	wh := NewWebhookHandler(NewWebhookRepository(db))
+	e.GET("/webhooks", wh.List, jwtAuth, RequireRole(roleAdmin))
+	e.POST("/webhooks", wh.Create, jwtAuth, RequireRole(roleAdmin))
+	e.GET("/webhooks/:id", wh.Get, jwtAuth, RequireRole(roleAdmin))
+	e.PUT("/webhooks/:id", wh.Replace, jwtAuth, RequireRole(roleAdmin))
+	e.DELETE("/webhooks/:id", wh.Delete, jwtAuth, RequireRole(roleAdmin))
+	e.GET("/webhooks/:id/deliveries", wh.Deliveries, jwtAuth, RequireRole(roleAdmin))
+
+	e.POST("/login", h.Login, loginRateLimiter(cfg))
+	e.POST("/refresh", h.Refresh)
+	e.POST("/logout", h.Logout)
+	e.POST("/password-reset/request", h.RequestPasswordReset, resetRateLimiter(cfg))
+	e.POST("/password-reset/confirm", h.ConfirmPasswordReset)
+
+	e.GET("/swagger/*", echoSwagger.WrapHandler)
+
+	health := NewHealthHandler(db)
+	e.GET("/health", health.Health)
+	e.GET("/readiness", health.Readiness)
+	e.GET("/version", health.Version)
+
+	return e
 }
@@ -0,0 +1,2276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-gormigrate/gormigrate/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testJWTSecret = "test-secret"
+	testPassword  = "Str0ng-passw0rd"
+)
+
+var (
+	testServer *echo.Echo
+	// testDB is nil unless TEST_DB_DSN names a database the suite may wipe.
+	// Without it only the tests that never reach the database run.
+	testDB *gorm.DB
+	seq    int
+)
+
+func TestMain(m *testing.M) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn != "" {
+		os.Setenv("DB_DSN", dsn)
+	} else {
+		os.Setenv("DB_DSN", "host=localhost")
+	}
+	os.Setenv("JWT_SECRET", testJWTSecret)
+	// Every test shares one server and so one set of rate limiters.
+	os.Setenv("LOGIN_RATE_LIMIT", "1000")
+	os.Setenv("PROFILE_RATE_LIMIT", "1000")
+	os.Setenv("PASSWORD_RESET_RATE_LIMIT", "1000")
+	os.Setenv("PHONE_VERIFY_RATE_LIMIT", "1000")
+	os.Setenv("EXISTS_RATE_LIMIT", "1000")
+	avatarDir, err := os.MkdirTemp("", "ums-avatars")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("AVATAR_DIR", avatarDir)
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var db *gorm.DB
+	if dsn != "" {
+		db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+		if err == nil {
+			err = migrate(db)
+		}
+		testDB = db
+	} else {
+		// Routing still needs a *gorm.DB; a dry-run one never connects.
+		db, err = gorm.Open(postgres.New(postgres.Config{DSN: cfg.DatabaseDSN}), &gorm.Config{
+			DryRun:                 true,
+			DisableAutomaticPing:   true,
+			SkipDefaultTransaction: true,
+			Logger:                 logger.Discard,
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testServer = newServer(cfg, db, logMailer{}, logSMSSender{})
+	code := m.Run()
+	os.RemoveAll(avatarDir)
+	os.Exit(code)
+}
+
+// requireDB skips t without a test database and otherwise empties every
+// table, so each test starts from a clean schema.
+func requireDB(t *testing.T) {
+	t.Helper()
+	if testDB == nil {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+	err := testDB.Exec(`TRUNCATE users, user_audits, refresh_tokens, password_reset_tokens,
+		password_histories, idempotency_keys, outbox_events, webhooks, webhook_deliveries
+		RESTART IDENTITY CASCADE`).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestUser stores an active user with testPassword and returns it along
+// with an access token for it.
+func createTestUser(t *testing.T, role string) (*Users, string) {
+	t.Helper()
+	seq++
+	hash, err := hashPassword(testPassword, bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &Users{
+		Username: "user" + strconv.Itoa(seq),
+		Password: hash,
+		Email:    "user" + strconv.Itoa(seq) + "@example.com",
+		IsActive: true,
+		Role:     role,
+	}
+	if err := testDB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token, err := generateToken(*user, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token
+}
+
+func doRequest(t *testing.T, method, path, token string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+// uploadFile posts content as the multipart form file field, named filename.
+func uploadFile(t *testing.T, path, token, field, filename string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	part, err := form.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, &buf)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	return rec
+}
+
+// expectStatus fails t unless rec has status code, then decodes the response's
+// data field into data when it is not nil.
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, code int, data interface{}) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, code, rec.Body.String())
+	}
+	if data != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), &SuccessResponse{Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectError fails t unless rec is an ErrorResponse with status code and
+// message msg.
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, code int, msg string) {
+	t.Helper()
+	expectStatus(t, rec, code, nil)
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != code || res.Message != msg {
+		t.Errorf("body = %+v, want code %d and message %q", res, code, msg)
+	}
+}
+
+func userPath(id int) string {
+	return "/users/" + strconv.Itoa(id)
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	rec := doRequest(t, http.MethodDelete, "/login", "", nil)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rec.Header().Get(echo.HeaderAllow); !strings.Contains(allow, http.MethodPost) {
+		t.Errorf("Allow = %q, want it to list POST", allow)
+	}
+	var res ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != http.StatusMethodNotAllowed || res.Message == "" {
+		t.Errorf("body = %+v, want an ErrorResponse with code 405", res)
+	}
+}
+
+func TestPasswordIsNotSerialized(t *testing.T) {
+	raw, err := json.Marshal(Users{Username: "alice", Password: "$2a$10$secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "password") || strings.Contains(string(raw), "secret") {
+		t.Errorf("json = %s, want no password", raw)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/health", "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	if rec.Header().Get(echo.HeaderXRequestID) == "" {
+		t.Error("response has no X-Request-ID")
+	}
+	rec = doRequest(t, http.MethodGet, "/health", "", nil, echo.HeaderXRequestID, "client-id")
+	if got := rec.Header().Get(echo.HeaderXRequestID); got != "client-id" {
+		t.Errorf("X-Request-ID = %q, want the client's client-id", got)
+	}
+}
+
+func TestMalformedJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("{bad json"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	testServer.ServeHTTP(rec, req)
+	expectError(t, rec, http.StatusBadRequest, "invalid request body")
+}
+
+func TestSwaggerSpec(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/swagger/doc.json", "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	var spec struct {
+		Paths map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/users", "/users/{id}", "/login"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("spec has no %s", path)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	expectStatus(t, doRequest(t, http.MethodGet, "/health", "", nil), http.StatusOK, nil)
+	rec := doRequest(t, http.MethodGet, "/metrics", "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	body := rec.Body.String()
+	for _, want := range []string{`ums_requests_total{code="200",host="example.com",method="GET",url="/health"}`, "ums_request_duration_seconds", "ums_users_total"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not include %s", want)
+		}
+	}
+}
+
+func TestGetRejectsUnknownFields(t *testing.T) {
+	expectError(t, doRequest(t, http.MethodGet, "/users/1?fields=username,password", "", nil), http.StatusBadRequest, "invalid field: password")
+}
+
+func TestGzip(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/swagger/doc.json", "", nil, echo.HeaderAcceptEncoding, "gzip")
+	expectStatus(t, rec, http.StatusOK, nil)
+	if rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get(echo.HeaderContentEncoding))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(zr).Decode(&map[string]interface{}{}); err != nil {
+		t.Errorf("decompressed body is not JSON: %v", err)
+	}
+
+	rec = doRequest(t, http.MethodGet, "/health", "", nil, echo.HeaderAcceptEncoding, "gzip")
+	if rec.Header().Get(echo.HeaderContentEncoding) != "" {
+		t.Error("a tiny response was compressed")
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": strings.Repeat("a", 2<<20)})
+	expectError(t, rec, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+
+	token, err := generateToken(Users{UserID: 1, Role: roleAdmin}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The import route has its own, larger limit, so 2MB reaches the handler
+	// and fails there instead.
+	rec = uploadFile(t, "/users/import", token, "file", "users.csv", bytes.Repeat([]byte("x"), 2<<20))
+	if rec.Code == http.StatusRequestEntityTooLarge {
+		t.Error("a 2MB import hit the JSON body limit")
+	}
+	rec = uploadFile(t, "/users/import", token, "file", "users.csv", bytes.Repeat([]byte("x"), 11<<20))
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge, nil)
+}
+
+func TestExistsNeedsOneField(t *testing.T) {
+	for _, query := range []string{"", "?username=alice&email=alice@example.com", "?username=%20"} {
+		rec := doRequest(t, http.MethodGet, "/users/exists"+query, "", nil)
+		expectError(t, rec, http.StatusBadRequest, "pass exactly one of username or email")
+	}
+}
+
+func TestNonIntegerID(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/users/abc", "", nil)
+	expectStatus(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestMigrations(t *testing.T) {
+	requireDB(t)
+	if err := migrate(testDB); err != nil {
+		t.Fatalf("migrating an up-to-date schema: %v", err)
+	}
+	m := gormigrate.New(testDB, gormigrate.DefaultOptions, migrations)
+	if err := m.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := migrationApplied(testDB, latestMigration()); err != nil || applied {
+		t.Fatalf("after rolling back, migrationApplied() = %v, %v", applied, err)
+	}
+	if err := migrate(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := appliedMigration(testDB); err != nil || id != latestMigration() {
+		t.Errorf("appliedMigration() = %q, %v; want %q", id, err, latestMigration())
+	}
+}
+
+func TestNamedUniqueIndexes(t *testing.T) {
+	requireDB(t)
+	for _, column := range []string{"username", "email", "phone"} {
+		if !testDB.Migrator().HasIndex(&Users{}, "idx_users_"+column) {
+			t.Errorf("users has no index idx_users_%s", column)
+		}
+		if testDB.Migrator().HasConstraint(&Users{}, "users_"+column+"_key") {
+			t.Errorf("users still has the constraint users_%s_key", column)
+		}
+	}
+
+	user, _ := createTestUser(t, roleUser)
+	err := testDB.Create(&Users{Username: "other", Email: user.Email, Password: "x"}).Error
+	if field, ok := uniqueViolationField(err); !ok || field != "email" {
+		t.Errorf("uniqueViolationField(%v) = %q, %v; want email", err, field, ok)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	requireDB(t)
+	var res map[string]string
+	expectStatus(t, doRequest(t, http.MethodGet, "/version", "", nil), http.StatusOK, &res)
+	if res["migration_version"] != latestMigration() || res["latest_migration"] != latestMigration() || res["version"] != version {
+		t.Errorf("version = %v, want build %s at migration %s", res, version, latestMigration())
+	}
+	expectStatus(t, doRequest(t, http.MethodGet, "/readiness", "", nil), http.StatusOK, nil)
+}
+
+func TestReadinessWaitsForMigrations(t *testing.T) {
+	requireDB(t)
+	m := gormigrate.New(testDB, gormigrate.DefaultOptions, migrations)
+	if err := m.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := migrate(testDB); err != nil {
+			t.Error(err)
+		}
+	})
+	previous, err := appliedMigration(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequest(t, http.MethodGet, "/readiness", "", nil)
+	expectError(t, rec, http.StatusServiceUnavailable, "database migrations are not applied")
+	var res struct {
+		Details map[string]string `json:"details"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Details["migration_version"] != previous || res.Details["latest_migration"] != latestMigration() {
+		t.Errorf("details = %v, want migration %s of %s", res.Details, previous, latestMigration())
+	}
+}
+
+func TestCreateAndGetUser(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+
+	var created Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{
+		"username": "alice",
+		"password": testPassword,
+		"email":    "alice@example.com",
+	})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	if created.UserID == 0 || created.Username != "alice" || created.IsActive {
+		t.Fatalf("created = %+v, want an inactive alice with an id", created)
+	}
+	if strings.Contains(rec.Body.String(), `"password"`) {
+		t.Errorf("body = %s, want no password", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"birthday":null`) {
+		t.Errorf("body = %s, want a null birthday", rec.Body.String())
+	}
+
+	var got Users
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(created.UserID), "", nil), http.StatusOK, &got)
+	if got.Email != "alice@example.com" {
+		t.Errorf("email = %q, want alice@example.com", got.Email)
+	}
+	expectError(t, doRequest(t, http.MethodGet, userPath(created.UserID+1000), "", nil), http.StatusNotFound, "user not found")
+
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{
+		"username": "alice2",
+		"password": testPassword,
+		"email":    "alice@example.com",
+	})
+	expectStatus(t, rec, http.StatusConflict, nil)
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{
+		"username": "alice",
+		"password": testPassword,
+		"email":    "alice2@example.com",
+	})
+	expectError(t, rec, http.StatusConflict, "username already exists")
+}
+
+func TestCreateWithIdempotencyKey(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	body := echo.Map{"username": "carol", "password": testPassword, "email": "carol@example.com"}
+
+	var first, retried Users
+	expectStatus(t, doRequest(t, http.MethodPost, "/users", token, body, headerIdempotencyKey, "key-1"), http.StatusCreated, &first)
+	expectStatus(t, doRequest(t, http.MethodPost, "/users", token, body, headerIdempotencyKey, "key-1"), http.StatusCreated, &retried)
+	if retried.UserID != first.UserID {
+		t.Errorf("retry created user %d, want the original %d", retried.UserID, first.UserID)
+	}
+	var n int64
+	if err := testDB.Model(&Users{}).Where("username = ?", "carol").Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d carols stored, want 1", n)
+	}
+
+	other := echo.Map{"username": "dave", "password": testPassword, "email": "dave@example.com"}
+	rec := doRequest(t, http.MethodPost, "/users", token, other, headerIdempotencyKey, "key-1")
+	expectError(t, rec, http.StatusConflict, "idempotency key was already used with a different request")
+}
+
+func TestGetETag(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+	rec := doRequest(t, http.MethodGet, path, "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET returned no ETag")
+	}
+
+	rec = doRequest(t, http.MethodGet, path, "", nil, "If-None-Match", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("matching If-None-Match: got %d with %s, want 304 and no body", rec.Code, rec.Body)
+	}
+	rec = doRequest(t, http.MethodGet, path+"?fields=username", "", nil, "If-None-Match", etag)
+	expectStatus(t, rec, http.StatusOK, nil)
+
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Ada", "version": user.Version})
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodGet, path, "", nil, "If-None-Match", etag)
+	expectStatus(t, rec, http.StatusOK, nil)
+	if rec.Header().Get("ETag") == etag {
+		t.Error("ETag did not change after an update")
+	}
+}
+
+func TestGetSelectedFields(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	var got map[string]interface{}
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(user.UserID)+"?fields=username,email", "", nil), http.StatusOK, &got)
+	if len(got) != 2 || got["username"] != user.Username || got["email"] != user.Email {
+		t.Errorf("got %v, want only username and email", got)
+	}
+}
+
+func TestCreateNormalizesEmail(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	var created Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": " erin ", "password": testPassword, "email": " Erin@Example.com "})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	if created.Username != "erin" || created.Email != "erin@example.com" {
+		t.Errorf("stored %q <%s>, want erin <erin@example.com>", created.Username, created.Email)
+	}
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "erin2", "password": testPassword, "email": "ERIN@example.com"})
+	expectError(t, rec, http.StatusConflict, "email already exists")
+}
+
+func TestPhoneIsOptionalButUnique(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	for _, name := range []string{"ivy", "jack"} {
+		var created Users
+		rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": name, "password": testPassword, "email": name + "@example.com", "phone": ""})
+		expectStatus(t, rec, http.StatusCreated, &created)
+		if created.Phone != nil {
+			t.Errorf("%s: phone = %q, want null", name, *created.Phone)
+		}
+	}
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "kate", "password": testPassword, "email": "kate@example.com", "phone": "+14155550123"})
+	expectStatus(t, rec, http.StatusCreated, nil)
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "liam", "password": testPassword, "email": "liam@example.com", "phone": "+14155550123"})
+	expectError(t, rec, http.StatusConflict, "phone already exists")
+}
+
+func TestCreateTimezone(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	var created Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "mia", "password": testPassword, "email": "mia@example.com"})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	if created.Timezone != defaultTimezone {
+		t.Errorf("timezone = %q, want %q", created.Timezone, defaultTimezone)
+	}
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "noah", "password": testPassword, "email": "noah@example.com", "timezone": "America/New_York"})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	if created.Timezone != "America/New_York" {
+		t.Errorf("timezone = %q, want America/New_York", created.Timezone)
+	}
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "olga", "password": testPassword, "email": "olga@example.com", "timezone": "Mars/Olympus"})
+	expectStatus(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestCreateRejectsMalformedBirthday(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleAdmin}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, birthday := range []string{"1990-13-45", "05/01/1990", "yesterday"} {
+		rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{
+			"username": "alice",
+			"password": testPassword,
+			"email":    "alice@example.com",
+			"birthday": birthday,
+		})
+		expectStatus(t, rec, http.StatusUnprocessableEntity, nil)
+		if !strings.Contains(rec.Body.String(), `"field":"birthday"`) {
+			t.Errorf("birthday %q: body = %s, want a birthday error", birthday, rec.Body.String())
+		}
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "bob", "password": "weak", "email": "nope"})
+	expectStatus(t, rec, http.StatusUnprocessableEntity, nil)
+	if !strings.Contains(rec.Body.String(), `"details"`) {
+		t.Errorf("body = %s, want per-field details", rec.Body.String())
+	}
+}
+
+func TestFailedTransactionLeavesNoUser(t *testing.T) {
+	requireDB(t)
+	errFailed := errors.New("failed after create")
+	err := NewUserRepository(testDB).Transaction(func(tx UserRepository) error {
+		if err := tx.Create(&Users{Username: "ghost", Password: "x", Email: "ghost@example.com"}); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Transaction() = %v, want %v", err, errFailed)
+	}
+	var n int64
+	if err := testDB.Unscoped().Model(&Users{}).Where("username = ?", "ghost").Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d ghost users persisted, want none", n)
+	}
+}
+
+func TestAvatarRejectsBadUploads(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleUser}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := uploadFile(t, "/users/1/avatar", token, "picture", "a.png", pngBytes(16))
+	expectError(t, rec, http.StatusBadRequest, "avatar is required")
+	rec = uploadFile(t, "/users/1/avatar", token, "avatar", "a.png", []byte("not an image"))
+	expectError(t, rec, http.StatusUnsupportedMediaType, "avatar must be a JPEG or PNG image")
+	rec = uploadFile(t, "/users/1/avatar", token, "avatar", "a.png", pngBytes(maxAvatarBytes+1))
+	expectError(t, rec, http.StatusRequestEntityTooLarge, "avatar must be at most 2MB")
+}
+
+// pngBytes returns n bytes that start with the PNG signature.
+func pngBytes(n int) []byte {
+	b := make([]byte, n)
+	copy(b, "\x89PNG\r\n\x1a\n")
+	return b
+}
+
+func TestAvatar(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID) + "/avatar"
+
+	var updated Users
+	expectStatus(t, uploadFile(t, path, token, "avatar", "me.png", pngBytes(64)), http.StatusOK, &updated)
+	if updated.AvatarURL == nil || !strings.HasSuffix(*updated.AvatarURL, ".png") {
+		t.Fatalf("avatar_url = %v, want a .png URL", updated.AvatarURL)
+	}
+	rec := doRequest(t, http.MethodGet, *updated.AvatarURL, "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	if rec.Body.Len() != 64 {
+		t.Errorf("served %d bytes, want 64", rec.Body.Len())
+	}
+
+	expectStatus(t, doRequest(t, http.MethodDelete, path, token, nil), http.StatusOK, &updated)
+	if updated.AvatarURL != nil {
+		t.Errorf("avatar_url = %q after DELETE, want null", *updated.AvatarURL)
+	}
+	expectError(t, doRequest(t, http.MethodDelete, path, token, nil), http.StatusNotFound, "user has no avatar")
+}
+
+func TestSlowQueryIsLogged(t *testing.T) {
+	requireDB(t)
+	logs := observeLogs(t, zapcore.WarnLevel)
+	db := testDB.Session(&gorm.Session{Logger: newGormLogger(&Config{DBLogLevel: "warn", DBSlowQueryThreshold: 10 * time.Millisecond})})
+	if err := db.Exec("SELECT pg_sleep(0.05)").Error; err != nil {
+		t.Fatal(err)
+	}
+	if slow := logs.FilterMessage("slow query").All(); len(slow) != 1 {
+		t.Errorf("logged %v, want one slow query", logs.All())
+	}
+}
+
+func TestCancelledQuery(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewUserRepository(testDB).WithContext(ctx).FindByID(strconv.Itoa(user.UserID))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("FindByID() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	var updated Users
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Ada"}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, &updated)
+	if updated.FirstName != "Ada" || updated.Version != user.Version+1 {
+		t.Fatalf("updated = %+v, want first_name Ada at the next version", updated)
+	}
+	if user.CreatedAt.IsZero() || !updated.UpdatedAt.After(user.UpdatedAt) {
+		t.Errorf("created_at %v, updated_at %v -> %v; want created_at set and updated_at to move on",
+			user.CreatedAt, user.UpdatedAt, updated.UpdatedAt)
+	}
+
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Grace"}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusConflict, nil)
+}
+
+func TestPatchClearsOptionalFields(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	var patched Users
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{
+		"first_name": "Ada",
+		"last_name":  "Lovelace",
+		"phone":      "+14155550123",
+		"birthday":   "1990-12-10",
+		"timezone":   "Europe/London",
+	}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, &patched)
+
+	// Omitted fields stay as they are.
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Augusta"}, "If-Match", strconv.Itoa(patched.Version))
+	expectStatus(t, rec, http.StatusOK, &patched)
+	if patched.LastName != "Lovelace" || patched.Phone == nil || patched.Birthday == nil {
+		t.Fatalf("after a one-field PATCH: %+v, want the other fields kept", patched)
+	}
+
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{
+		"first_name": "",
+		"last_name":  "",
+		"phone":      "",
+		"birthday":   "",
+		"timezone":   "",
+	}, "If-Match", strconv.Itoa(patched.Version))
+	expectStatus(t, rec, http.StatusOK, &patched)
+	if patched.FirstName != "" || patched.LastName != "" || patched.Phone != nil || patched.Birthday != nil || patched.Timezone != defaultTimezone {
+		t.Errorf("after clearing: %+v, want empty names, no phone or birthday and timezone %s", patched, defaultTimezone)
+	}
+}
+
+func TestUpdateNeedsVersion(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Ada"})
+	expectError(t, rec, http.StatusPreconditionRequired, "send the user version in If-Match or the version field")
+	var updated Users
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Ada", "version": user.Version})
+	expectStatus(t, rec, http.StatusOK, &updated)
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Grace"}, "If-Match", `W/"`+strconv.Itoa(updated.Version)+`"`)
+	expectStatus(t, rec, http.StatusOK, nil)
+}
+
+func TestConcurrentUpdateConflicts(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	repo := NewUserRepository(testDB)
+	first, second := *user, *user
+	first.FirstName = "Ada"
+	if err := repo.Update(&first); err != nil {
+		t.Fatal(err)
+	}
+	second.FirstName = "Grace"
+	if err := repo.Update(&second); !errors.Is(err, errVersionConflict) {
+		t.Errorf("second Update() = %v, want %v", err, errVersionConflict)
+	}
+}
+
+func TestPutReplacesWhilePatchMerges(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	var patched Users
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Ada", "last_name": "Lovelace"}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, &patched)
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"last_name": "King"}, "If-Match", strconv.Itoa(patched.Version))
+	expectStatus(t, rec, http.StatusOK, &patched)
+	if patched.FirstName != "Ada" || patched.LastName != "King" {
+		t.Fatalf("after PATCH: %q %q, want Ada King", patched.FirstName, patched.LastName)
+	}
+
+	var replaced Users
+	rec = doRequest(t, http.MethodPut, path, token, echo.Map{
+		"username": user.Username,
+		"password": testPassword,
+		"email":    user.Email,
+		"version":  patched.Version,
+	})
+	expectStatus(t, rec, http.StatusOK, &replaced)
+	if replaced.FirstName != "" || replaced.LastName != "" {
+		t.Errorf("after PUT: %q %q, want both names cleared", replaced.FirstName, replaced.LastName)
+	}
+}
+
+func TestUpdateToTakenEmail(t *testing.T) {
+	requireDB(t)
+	a, _ := createTestUser(t, roleUser)
+	b, token := createTestUser(t, roleUser)
+	rec := doRequest(t, http.MethodPatch, userPath(b.UserID), token, echo.Map{"email": a.Email}, "If-Match", strconv.Itoa(b.Version))
+	expectError(t, rec, http.StatusConflict, "email already in use")
+}
+
+func TestChangingAnotherUserIsForbidden(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleUser)
+	other, _ := createTestUser(t, roleUser)
+	path := userPath(other.UserID)
+
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{"first_name": "Mallory"}, "If-Match", strconv.Itoa(other.Version))
+	expectStatus(t, rec, http.StatusForbidden, nil)
+	rec = doRequest(t, http.MethodPut, path, token, echo.Map{
+		"username": other.Username,
+		"password": testPassword,
+		"email":    "mallory@example.com",
+		"version":  other.Version,
+	})
+	expectStatus(t, rec, http.StatusForbidden, nil)
+}
+
+func TestListUsers(t *testing.T) {
+	requireDB(t)
+	_, userToken := createTestUser(t, roleUser)
+	_, adminToken := createTestUser(t, roleAdmin)
+
+	expectStatus(t, doRequest(t, http.MethodGet, "/users", "", nil), http.StatusUnauthorized, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, "/users", userToken, nil), http.StatusForbidden, nil)
+
+	var users []Users
+	rec := doRequest(t, http.MethodGet, "/users", adminToken, nil)
+	expectStatus(t, rec, http.StatusOK, &users)
+	if len(users) != 2 || rec.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("got %d users, X-Total-Count %q; want 2", len(users), rec.Header().Get("X-Total-Count"))
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleAdmin)
+
+	var list struct {
+		Data []Users  `json:"data"`
+		Meta PageMeta `json:"meta"`
+	}
+	rec := doRequest(t, http.MethodGet, "/users", token, nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 1 || list.Meta.Total != 1 || list.Meta.Page != 1 {
+		t.Errorf("list body = %s, want one user in data and page meta", rec.Body.String())
+	}
+
+	var single map[string]json.RawMessage
+	rec = doRequest(t, http.MethodGet, userPath(user.UserID), "", nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &single); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := single["data"]; !ok || len(single) != 1 {
+		t.Errorf("single body = %s, want only a data key", rec.Body.String())
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	for i := 0; i < 4; i++ {
+		createTestUser(t, roleUser)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []int
+	}{
+		{"page=1&limit=2", []int{1, 2}},
+		{"page=2&limit=2", []int{3, 4}},
+		{"page=9&limit=2", nil},
+	} {
+		var users []Users
+		rec := doRequest(t, http.MethodGet, "/users?"+tc.query, token, nil)
+		expectStatus(t, rec, http.StatusOK, &users)
+		var ids []int
+		for _, u := range users {
+			ids = append(ids, u.UserID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tc.want) || rec.Header().Get("X-Total-Count") != "5" {
+			t.Errorf("%s: got ids %v of %s, want %v of 5", tc.query, ids, rec.Header().Get("X-Total-Count"), tc.want)
+		}
+	}
+}
+
+func TestListIsCompressed(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	for i := 0; i < 10; i++ {
+		createTestUser(t, roleUser)
+	}
+	rec := doRequest(t, http.MethodGet, "/users", token, nil, echo.HeaderAcceptEncoding, "gzip")
+	expectStatus(t, rec, http.StatusOK, nil)
+	if rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", rec.Header().Get(echo.HeaderContentEncoding))
+	}
+}
+
+func TestListByCursor(t *testing.T) {
+	requireDB(t)
+	admin, token := createTestUser(t, roleAdmin)
+	want := []int{admin.UserID}
+	for i := 0; i < 4; i++ {
+		user, _ := createTestUser(t, roleUser)
+		want = append(want, user.UserID)
+	}
+
+	var got []int
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("cursor pagination does not end")
+		}
+		var page struct {
+			Data []Users    `json:"data"`
+			Meta CursorMeta `json:"meta"`
+		}
+		rec := doRequest(t, http.MethodGet, "/users?limit=2&cursor="+cursor, token, nil)
+		expectStatus(t, rec, http.StatusOK, nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range page.Data {
+			got = append(got, u.UserID)
+		}
+		if page.Meta.NextCursor == "" {
+			break
+		}
+		cursor = page.Meta.NextCursor
+		if pages == 0 {
+			// A user added mid-iteration sorts last and must not shift pages.
+			user, _ := createTestUser(t, roleUser)
+			want = append(want, user.UserID)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("iterated %v, want %v", got, want)
+	}
+	expectError(t, doRequest(t, http.MethodGet, "/users?cursor=bogus", token, nil), http.StatusBadRequest, "invalid cursor")
+}
+
+func TestListOrderIsStable(t *testing.T) {
+	requireDB(t)
+	admin, token := createTestUser(t, roleAdmin)
+	want := []int{admin.UserID}
+	var users []*Users
+	for i := 0; i < 4; i++ {
+		user, _ := createTestUser(t, roleUser)
+		users = append(users, user)
+		want = append(want, user.UserID)
+	}
+	// Updating rows moves them in the heap, so an unordered scan would
+	// return them out of id order.
+	for _, user := range []*Users{users[1], users[0]} {
+		if err := testDB.Model(user).UpdateColumn("first_name", "moved").Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		var listed []Users
+		expectStatus(t, doRequest(t, http.MethodGet, "/users", token, nil), http.StatusOK, &listed)
+		var ids []int
+		for _, u := range listed {
+			ids = append(ids, u.UserID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("request %d listed %v, want %v", i+1, ids, want)
+		}
+	}
+}
+
+func TestListFiltersActive(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	inactive, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(inactive).UpdateColumn("is_active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]int{"active=true": 1, "active=false": 1, "": 2} {
+		var users []Users
+		expectStatus(t, doRequest(t, http.MethodGet, "/users?"+query, token, nil), http.StatusOK, &users)
+		if len(users) != want {
+			t.Errorf("%q: got %d users, want %d", query, len(users), want)
+		}
+	}
+}
+
+func TestListFiltersCreatedRange(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	january, _ := createTestUser(t, roleUser)
+	march, _ := createTestUser(t, roleUser)
+	for user, created := range map[*Users]time.Time{
+		january: time.Date(2026, 1, 15, 12, 0, 0, 0, time.UTC),
+		march:   time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC),
+	} {
+		if err := testDB.Model(user).UpdateColumn("created_at", created).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for query, want := range map[string][]int{
+		"created_from=2026-01-01&created_to=2026-01-31": {january.UserID},
+		"created_from=2026-01-01&created_to=2026-03-31": {january.UserID, march.UserID},
+		"created_to=2026-01-14":                         nil,
+	} {
+		var users []Users
+		expectStatus(t, doRequest(t, http.MethodGet, "/users?sort=user_id&"+query, token, nil), http.StatusOK, &users)
+		var ids []int
+		for _, u := range users {
+			ids = append(ids, u.UserID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(want) {
+			t.Errorf("%s: got %v, want %v", query, ids, want)
+		}
+	}
+	rec := doRequest(t, http.MethodGet, "/users?created_from=2026-02-01&created_to=2026-01-01", token, nil)
+	expectError(t, rec, http.StatusBadRequest, "created_from must not be after created_to")
+}
+
+func TestExists(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	for query, want := range map[string]bool{
+		"username=" + user.Username:            true,
+		"username=nobody":                      false,
+		"email=" + strings.ToUpper(user.Email): true,
+		"email=nobody@example.com":             false,
+	} {
+		var res map[string]bool
+		expectStatus(t, doRequest(t, http.MethodGet, "/users/exists?"+query, "", nil), http.StatusOK, &res)
+		if res["exists"] != want {
+			t.Errorf("%s: exists = %v, want %v", query, res["exists"], want)
+		}
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	_, userToken := createTestUser(t, roleUser)
+	inactive, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(inactive).UpdateColumn("is_active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/count", userToken, nil), http.StatusForbidden, nil)
+	for query, want := range map[string]int64{"": 3, "?active=true": 2, "?active=false": 1} {
+		var res map[string]int64
+		expectStatus(t, doRequest(t, http.MethodGet, "/users/count"+query, token, nil), http.StatusOK, &res)
+		if res["total"] != want {
+			t.Errorf("%q: total = %d, want %d", query, res["total"], want)
+		}
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	match, _ := createTestUser(t, roleUser)
+	createTestUser(t, roleUser)
+	if err := testDB.Model(match).UpdateColumn("first_name", "Alexandra").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var users []Users
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/search?q=ALEX", token, nil), http.StatusOK, &users)
+	if len(users) != 1 || users[0].UserID != match.UserID {
+		t.Errorf("search for ALEX returned %+v, want only user %d", users, match.UserID)
+	}
+	users = nil
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/search?q=nobody", token, nil), http.StatusOK, &users)
+	if len(users) != 0 {
+		t.Errorf("search for nobody returned %d users, want none", len(users))
+	}
+}
+
+func TestFullTextSearch(t *testing.T) {
+	requireDB(t)
+	if !testDB.Migrator().HasColumn(&Users{}, "search_vector") {
+		t.Skip("postgres is older than 12, so search uses ILIKE")
+	}
+	_, token := createTestUser(t, roleAdmin)
+	byName, _ := createTestUser(t, roleUser)
+	byUsername, _ := createTestUser(t, roleUser)
+	other, _ := createTestUser(t, roleUser)
+	for user, columns := range map[*Users]map[string]interface{}{
+		byName:     {"first_name": "Ada", "last_name": "Lovelace"},
+		byUsername: {"username": "lovelace", "first_name": "Ada"},
+		other:      {"first_name": "Ada", "last_name": "Byron"},
+	} {
+		if err := testDB.Model(user).UpdateColumns(columns).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var users []Users
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/search?q=ada%20love", token, nil), http.StatusOK, &users)
+	if len(users) != 2 || users[0].UserID != byUsername.UserID || users[1].UserID != byName.UserID {
+		t.Errorf("search for ada love returned %+v, want user %d ranked above user %d", users, byUsername.UserID, byName.UserID)
+	}
+	users = nil
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/search?q=LOVE%20%26%20!ada", token, nil), http.StatusOK, &users)
+	if len(users) != 2 {
+		t.Errorf("search with tsquery operators returned %d users, want 2", len(users))
+	}
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/search?q=%26%7C!", token, nil), http.StatusOK, nil)
+}
+
+func TestExportCSV(t *testing.T) {
+	requireDB(t)
+	admin, token := createTestUser(t, roleAdmin)
+	rec := doRequest(t, http.MethodGet, "/users/export", token, nil)
+	expectStatus(t, rec, http.StatusOK, nil)
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || fmt.Sprint(rows[0]) != fmt.Sprint(exportHeader) {
+		t.Fatalf("rows = %q, want the header and one user", rows)
+	}
+	if rows[1][0] != strconv.Itoa(admin.UserID) || rows[1][1] != admin.Username {
+		t.Errorf("data row = %q, want user %d %s", rows[1], admin.UserID, admin.Username)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+
+	var result ImportResult
+	clean := "username,email,first_name\ncarol,carol@example.com,Carol\ndave,dave@example.com,Dave\n"
+	expectStatus(t, uploadFile(t, "/users/import", token, "file", "users.csv", []byte(clean)), http.StatusOK, &result)
+	if result.Imported != 2 || len(result.Failed) != 0 {
+		t.Errorf("clean import = %+v, want 2 imported", result)
+	}
+
+	result = ImportResult{}
+	mixed := "username,email\nerin,erin@example.com\nfrank,not-an-email\n"
+	expectStatus(t, uploadFile(t, "/users/import", token, "file", "users.csv", []byte(mixed)), http.StatusOK, &result)
+	if result.Imported != 1 || len(result.Failed) != 1 || result.Failed[0].Row != 3 {
+		t.Errorf("import with a bad row = %+v, want 1 imported and row 3 failed", result)
+	}
+}
+
+func TestDeleteInactive(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	expectError(t, doRequest(t, http.MethodDelete, "/users/inactive", token, nil), http.StatusBadRequest, "older_than is required")
+	expectStatus(t, doRequest(t, http.MethodDelete, "/users/inactive?older_than=soon", token, nil), http.StatusBadRequest, nil)
+
+	old := time.Now().AddDate(0, 0, -40)
+	stale, _ := createTestUser(t, roleUser)
+	recent, _ := createTestUser(t, roleUser)
+	active, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(&Users{}).Where("user_id IN ?", []int{stale.UserID, recent.UserID}).Update("is_active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.Model(&Users{}).Where("user_id IN ?", []int{stale.UserID, active.UserID}).Update("created_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]int
+	expectStatus(t, doRequest(t, http.MethodDelete, "/users/inactive?older_than=30d", token, nil), http.StatusOK, &res)
+	if res["deleted"] != 1 {
+		t.Errorf("deleted = %d, want 1", res["deleted"])
+	}
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(stale.UserID), "", nil), http.StatusNotFound, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(recent.UserID), "", nil), http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(active.UserID), "", nil), http.StatusOK, nil)
+}
+
+func TestDeleteRevokesCredentials(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	deleted, _ := createTestUser(t, roleUser)
+	stale, _ := createTestUser(t, roleUser)
+	kept, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(stale).UpdateColumns(map[string]interface{}{"is_active": false, "created_at": time.Now().AddDate(0, 0, -40)}).Error; err != nil {
+		t.Fatal(err)
+	}
+	refresh := map[int]string{}
+	reset := map[int]string{}
+	for _, user := range []*Users{deleted, stale, kept} {
+		raw, err := randomToken(refreshTokenBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := RefreshToken{TokenHash: hashToken(raw), UserID: user.UserID, ExpiresAt: time.Now().Add(time.Hour)}
+		if err := testDB.Create(&rt).Error; err != nil {
+			t.Fatal(err)
+		}
+		refresh[user.UserID] = raw
+		reset[user.UserID] = createResetToken(t, user.UserID, time.Now().Add(time.Hour))
+	}
+
+	expectStatus(t, doRequest(t, http.MethodDelete, userPath(deleted.UserID), token, nil), http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodDelete, "/users/inactive?older_than=30d", token, nil), http.StatusOK, nil)
+
+	for _, user := range []*Users{deleted, stale} {
+		rec := doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": refresh[user.UserID]})
+		expectError(t, rec, http.StatusUnauthorized, "refresh token has been revoked")
+		rec = doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset[user.UserID], "new_password": "N3w-passw0rd"})
+		expectError(t, rec, http.StatusBadRequest, invalidResetToken)
+	}
+	rec := doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": refresh[kept.UserID]})
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset[kept.UserID], "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+}
+
+func TestWebhooks(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	_, userToken := createTestUser(t, roleUser)
+	request := echo.Map{"url": "https://hooks.example/users", "secret": "0123456789abcdef", "events": []string{"user.created"}}
+	expectStatus(t, doRequest(t, http.MethodPost, "/webhooks", userToken, request), http.StatusForbidden, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, "/webhooks", userToken, nil), http.StatusForbidden, nil)
+	bad := echo.Map{"url": "hooks.example", "secret": "short", "events": []string{"user.renamed"}}
+	expectStatus(t, doRequest(t, http.MethodPost, "/webhooks", token, bad), http.StatusUnprocessableEntity, nil)
+
+	rec := doRequest(t, http.MethodPost, "/webhooks", token, request)
+	var hook Webhook
+	expectStatus(t, rec, http.StatusCreated, &hook)
+	if !hook.Active || hook.URL != "https://hooks.example/users" || strings.Contains(rec.Body.String(), "0123456789abcdef") {
+		t.Errorf("created %s, want an active webhook without its secret", rec.Body)
+	}
+	path := fmt.Sprintf("/webhooks/%d", hook.ID)
+	var hooks []Webhook
+	expectStatus(t, doRequest(t, http.MethodGet, "/webhooks", token, nil), http.StatusOK, &hooks)
+	if len(hooks) != 1 || hooks[0].ID != hook.ID {
+		t.Errorf("listed %+v, want webhook %d", hooks, hook.ID)
+	}
+
+	request["active"] = false
+	request["events"] = []string{"user.updated", "user.deleted"}
+	expectStatus(t, doRequest(t, http.MethodPut, path, token, request), http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, path, token, nil), http.StatusOK, &hook)
+	if hook.Active || len(hook.Events) != 2 {
+		t.Errorf("after replacing: %+v, want an inactive webhook with two events", hook)
+	}
+
+	expectStatus(t, doRequest(t, http.MethodDelete, path, token, nil), http.StatusOK, nil)
+	expectError(t, doRequest(t, http.MethodGet, path, token, nil), http.StatusNotFound, "webhook not found")
+	expectError(t, doRequest(t, http.MethodPut, path, token, request), http.StatusNotFound, "webhook not found")
+	expectError(t, doRequest(t, http.MethodGet, path+"/deliveries", token, nil), http.StatusNotFound, "webhook not found")
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	status := http.StatusOK
+	var signatures []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+signWebhook("0123456789abcdef", body) {
+			t.Errorf("delivery %s has a bad signature", r.Header.Get("X-Webhook-Delivery"))
+		}
+		signatures = append(signatures, r.Header.Get("X-Webhook-Signature"))
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	// Only the first webhook is both active and subscribed to user.created.
+	var hooks []Webhook
+	for _, request := range []echo.Map{
+		{"url": receiver.URL, "secret": "0123456789abcdef", "events": []string{"user.created"}},
+		{"url": receiver.URL, "secret": "0123456789abcdef", "events": []string{"user.created"}, "active": false},
+		{"url": receiver.URL, "secret": "0123456789abcdef", "events": []string{"user.deleted"}},
+	} {
+		var hook Webhook
+		expectStatus(t, doRequest(t, http.MethodPost, "/webhooks", token, request), http.StatusCreated, &hook)
+		hooks = append(hooks, hook)
+	}
+	hook := hooks[0]
+	deliveriesPath := fmt.Sprintf("/webhooks/%d/deliveries", hook.ID)
+	webhooks := NewWebhookRepository(testDB)
+	deliver := func(username string) []WebhookDelivery {
+		t.Helper()
+		rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": username, "password": testPassword, "email": username + "@example.com"})
+		expectStatus(t, rec, http.StatusCreated, nil)
+		publisher := NewWebhookPublisher(webhooks)
+		if _, err := NewOutboxRepository(testDB).Relay(outboxBatchSize, func(event OutboxEvent) error {
+			return publisher.Publish(Event{Type: event.Type, UserID: event.UserID, OccurredAt: event.OccurredAt})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		due, err := webhooks.ClaimDue(webhookBatchSize, webhookLease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range due {
+			deliverWebhook(context.Background(), webhooks, receiver.Client(), &due[i])
+		}
+		return due
+	}
+
+	if due := deliver("quinn"); len(due) != 1 || due[0].WebhookID != hook.ID {
+		t.Fatalf("claimed %+v, want one delivery to webhook %d", due, hook.ID)
+	}
+	if len(signatures) != 1 {
+		t.Fatalf("receiver got %d deliveries, want 1", len(signatures))
+	}
+	var deliveries []WebhookDelivery
+	expectStatus(t, doRequest(t, http.MethodGet, deliveriesPath, token, nil), http.StatusOK, &deliveries)
+	if len(deliveries) != 1 || deliveries[0].DeliveredAt == nil || deliveries[0].Attempts != 1 {
+		t.Errorf("deliveries = %+v, want one delivered on the first attempt", deliveries)
+	}
+
+	status = http.StatusInternalServerError
+	deliver("rosa")
+	expectStatus(t, doRequest(t, http.MethodGet, deliveriesPath, token, nil), http.StatusOK, &deliveries)
+	failed := deliveries[0]
+	if len(deliveries) != 2 || failed.DeliveredAt != nil || failed.FailedAt != nil || failed.LastError == "" || !failed.NextAttemptAt.After(time.Now()) {
+		t.Errorf("latest delivery = %+v, want a failed attempt scheduled for retry", failed)
+	}
+	if due, err := webhooks.ClaimDue(webhookBatchSize, webhookLease); err != nil || len(due) != 0 {
+		t.Errorf("ClaimDue() before the retry is due = %+v, %v; want none", due, err)
+	}
+}
+
+// relayEvents publishes every pending outbox event and returns them in order.
+func relayEvents(t *testing.T) []Event {
+	t.Helper()
+	ch := NewChannelPublisher(outboxBatchSize)
+	if _, err := NewOutboxRepository(testDB).Relay(outboxBatchSize, func(event OutboxEvent) error {
+		return ch.Publish(Event{Type: event.Type, UserID: event.UserID, OccurredAt: event.OccurredAt})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	for len(ch.Events()) > 0 {
+		events = append(events, <-ch.Events())
+	}
+	return events
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	var created Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "frank", "password": testPassword, "email": "frank@example.com"})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	rec = doRequest(t, http.MethodPatch, userPath(created.UserID), token, echo.Map{"first_name": "Frank"}, "If-Match", strconv.Itoa(created.Version))
+	expectStatus(t, rec, http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodDelete, userPath(created.UserID), token, nil), http.StatusOK, nil)
+
+	var got []EventType
+	for _, event := range relayEvents(t) {
+		if event.UserID != created.UserID || event.OccurredAt.IsZero() {
+			t.Errorf("event %+v, want one for user %d with a timestamp", event, created.UserID)
+		}
+		got = append(got, event.Type)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]EventType{UserCreated, UserUpdated, UserDeleted}) {
+		t.Errorf("events = %v, want created, updated, deleted", got)
+	}
+}
+
+func TestOutboxCommitsWithChange(t *testing.T) {
+	requireDB(t)
+	errFailed := errors.New("failed after enqueue")
+	err := NewUserRepository(testDB).Transaction(func(tx UserRepository) error {
+		if err := enqueueEvent(tx, UserCreated, 1); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Transaction() = %v, want %v", err, errFailed)
+	}
+	if events := relayEvents(t); len(events) != 0 {
+		t.Errorf("rolled-back change left events %v", events)
+	}
+}
+
+func TestRelayRetriesFailedEvents(t *testing.T) {
+	requireDB(t)
+	users := NewUserRepository(testDB)
+	for _, userID := range []int{1, 2} {
+		if err := enqueueEvent(users, UserUpdated, userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errDown := errors.New("broker down")
+	outbox := NewOutboxRepository(testDB)
+	n, err := outbox.Relay(outboxBatchSize, func(event OutboxEvent) error {
+		if event.UserID == 2 {
+			return errDown
+		}
+		return nil
+	})
+	if n != 1 || !errors.Is(err, errDown) {
+		t.Fatalf("first Relay() = %d, %v; want 1 published and %v", n, err, errDown)
+	}
+	events := relayEvents(t)
+	if len(events) != 1 || events[0].UserID != 2 {
+		t.Errorf("retry published %v, want only user 2's event", events)
+	}
+	if events := relayEvents(t); len(events) != 0 {
+		t.Errorf("published events were sent again: %v", events)
+	}
+}
+
+func TestDeleteReportsFailures(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	user, _ := createTestUser(t, roleUser)
+	expectError(t, doRequest(t, http.MethodDelete, userPath(user.UserID+1000), token, nil), http.StatusNotFound, "user not found")
+
+	// Make the soft delete itself fail.
+	err := testDB.Exec(`CREATE FUNCTION refuse_delete() RETURNS trigger LANGUAGE plpgsql AS
+		$$ BEGIN RAISE EXCEPTION 'deletes are disabled'; END $$`).Error
+	if err == nil {
+		err = testDB.Exec(`CREATE TRIGGER refuse_delete BEFORE UPDATE OF deleted_at ON users
+			FOR EACH ROW EXECUTE FUNCTION refuse_delete()`).Error
+	}
+	t.Cleanup(func() { testDB.Exec("DROP FUNCTION IF EXISTS refuse_delete CASCADE") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := doRequest(t, http.MethodDelete, userPath(user.UserID), token, nil)
+	expectStatus(t, rec, http.StatusInternalServerError, nil)
+	if !strings.Contains(rec.Body.String(), "deletes are disabled") {
+		t.Errorf("body = %s, want the database error", rec.Body.String())
+	}
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(user.UserID), "", nil), http.StatusOK, nil)
+}
+
+func TestDeleteRequiresAdmin(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleUser}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, doRequest(t, http.MethodDelete, userPath(2), token, nil), http.StatusForbidden, "insufficient permissions")
+}
+
+func TestDeleteUser(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	user, _ := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	listed := func() int {
+		var users []Users
+		expectStatus(t, doRequest(t, http.MethodGet, "/users", token, nil), http.StatusOK, &users)
+		return len(users)
+	}
+
+	expectStatus(t, doRequest(t, http.MethodDelete, path, token, nil), http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, path, "", nil), http.StatusNotFound, nil)
+	if n := listed(); n != 1 {
+		t.Errorf("listing after delete has %d users, want 1", n)
+	}
+	var stored Users
+	if err := testDB.Unscoped().First(&stored, user.UserID).Error; err != nil || !stored.DeletedAt.Valid {
+		t.Errorf("deleted row = %+v, %v; want it kept with deleted_at set", stored, err)
+	}
+	expectStatus(t, doRequest(t, http.MethodPost, path+"/restore", token, nil), http.StatusOK, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, path, "", nil), http.StatusOK, nil)
+	if n := listed(); n != 2 {
+		t.Errorf("listing after restore has %d users, want 2", n)
+	}
+}
+
+func TestBulkUpdate(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	first, userToken := createTestUser(t, roleUser)
+	second, _ := createTestUser(t, roleUser)
+	rec := doRequest(t, http.MethodPatch, "/users/bulk", userToken, echo.Map{"ids": []int{first.UserID}, "patch": echo.Map{"is_active": false}})
+	expectStatus(t, rec, http.StatusForbidden, nil)
+
+	body := echo.Map{"ids": []int{first.UserID, second.UserID, second.UserID + 1000}, "patch": echo.Map{"is_active": false}}
+	var res map[string]int
+	expectStatus(t, doRequest(t, http.MethodPatch, "/users/bulk", token, body), http.StatusOK, &res)
+	if res["updated"] != 2 {
+		t.Errorf("updated = %d, want 2", res["updated"])
+	}
+	for _, user := range []*Users{first, second} {
+		var got Users
+		expectStatus(t, doRequest(t, http.MethodGet, userPath(user.UserID), "", nil), http.StatusOK, &got)
+		if got.IsActive {
+			t.Errorf("user %d is still active", user.UserID)
+		}
+		expectUpdateRecorded(t, user.UserID, "is_active")
+	}
+
+	expectStatus(t, doRequest(t, http.MethodPatch, "/users/bulk", token, body), http.StatusOK, &res)
+	if res["updated"] != 0 {
+		t.Errorf("repeating the patch updated %d users, want 0", res["updated"])
+	}
+}
+
+// expectUpdateRecorded checks that the user's latest audit entry is an update
+// changing field, and that a UserUpdated event is waiting in the outbox.
+func expectUpdateRecorded(t *testing.T, userID int, field string) {
+	t.Helper()
+	var entry UserAudit
+	if err := testDB.Where("user_id = ?", userID).Order("id DESC").First(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry.Changes[field]; entry.Action != auditUpdate || !ok {
+		t.Errorf("latest audit entry is %s of %v, want an update of %s", entry.Action, entry.Changes, field)
+	}
+	if change, ok := entry.Changes["password"]; ok && change.New != "[redacted]" {
+		t.Errorf("audit entry records password %v", change.New)
+	}
+	var events int64
+	err := testDB.Model(&OutboxEvent{}).Where("user_id = ? AND type = ?", userID, UserUpdated).Count(&events).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events == 0 {
+		t.Errorf("no %s event for user %d", UserUpdated, userID)
+	}
+}
+
+func TestAuditHistory(t *testing.T) {
+	requireDB(t)
+	admin, token := createTestUser(t, roleAdmin)
+	_, userToken := createTestUser(t, roleUser)
+	var created Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "gina", "password": testPassword, "email": "gina@example.com"})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	rec = doRequest(t, http.MethodPatch, userPath(created.UserID), token, echo.Map{"last_name": "Smith"}, "If-Match", strconv.Itoa(created.Version))
+	expectStatus(t, rec, http.StatusOK, nil)
+
+	path := userPath(created.UserID) + "/audit"
+	expectStatus(t, doRequest(t, http.MethodGet, path, userToken, nil), http.StatusForbidden, nil)
+	var entries []UserAudit
+	expectStatus(t, doRequest(t, http.MethodGet, path, token, nil), http.StatusOK, &entries)
+	if len(entries) != 2 || entries[0].Action != auditUpdate || entries[1].Action != auditCreate {
+		t.Fatalf("entries = %+v, want an update after a create", entries)
+	}
+	for _, entry := range entries {
+		if entry.ActorID == nil || *entry.ActorID != admin.UserID {
+			t.Errorf("%s by %v, want admin %d", entry.Action, entry.ActorID, admin.UserID)
+		}
+	}
+	if c := entries[0].Changes["last_name"]; c.New != "Smith" {
+		t.Errorf("update changes = %v, want last_name set to Smith", entries[0].Changes)
+	}
+}
+
+func TestVerification(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	err := testDB.Model(user).UpdateColumns(map[string]interface{}{
+		"is_active":               false,
+		"verification_token_hash": hashToken("verify-me"),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func() *httptest.ResponseRecorder {
+		return doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	}
+
+	expectStatus(t, login(), http.StatusForbidden, nil)
+	expectError(t, doRequest(t, http.MethodGet, "/users/verify?token=wrong", "", nil), http.StatusBadRequest, "invalid verification token")
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/verify?token=verify-me", "", nil), http.StatusOK, nil)
+	expectStatus(t, login(), http.StatusOK, nil)
+	// The token is spent once used.
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/verify?token=verify-me", "", nil), http.StatusBadRequest, nil)
+}
+
+func TestVerifyRecordsChange(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	err := testDB.Model(user).UpdateColumns(map[string]interface{}{
+		"is_active":               false,
+		"verification_token_hash": hashToken("verify-me"),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, doRequest(t, http.MethodGet, "/users/verify?token=verify-me", "", nil), http.StatusOK, nil)
+	expectUpdateRecorded(t, user.UserID, "is_active")
+}
+
+func TestLogin(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "Wr0ng-password"})
+	expectStatus(t, rec, http.StatusUnauthorized, nil)
+
+	var tokens map[string]string
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	expectStatus(t, rec, http.StatusOK, &tokens)
+	if tokens["token"] == "" || tokens["refresh_token"] == "" {
+		t.Fatalf("tokens = %v, want an access and a refresh token", tokens)
+	}
+
+	var me Users
+	expectStatus(t, doRequest(t, http.MethodGet, "/me", tokens["token"], nil), http.StatusOK, &me)
+	if me.UserID != user.UserID {
+		t.Errorf("/me returned user %d, want %d", me.UserID, user.UserID)
+	}
+}
+
+func TestLoginDoesNotRevealUsernames(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": "nobody", "password": testPassword})
+	expectError(t, rec, http.StatusUnauthorized, invalidCredentials)
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "Wr0ng-password"})
+	expectError(t, rec, http.StatusUnauthorized, invalidCredentials)
+}
+
+func TestDeactivateBlocksLogin(t *testing.T) {
+	requireDB(t)
+	_, admin := createTestUser(t, roleAdmin)
+	user, token := createTestUser(t, roleUser)
+	login := func() *httptest.ResponseRecorder {
+		return doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	}
+	var tokens map[string]string
+	expectStatus(t, login(), http.StatusOK, &tokens)
+
+	path := userPath(user.UserID)
+	expectStatus(t, doRequest(t, http.MethodPost, path+"/deactivate", token, nil), http.StatusForbidden, nil)
+	var got Users
+	expectStatus(t, doRequest(t, http.MethodPost, path+"/deactivate", admin, nil), http.StatusOK, &got)
+	if got.IsActive {
+		t.Error("is_active = true after deactivating")
+	}
+	expectError(t, login(), http.StatusForbidden, "account is not verified or has been deactivated")
+	rec := doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": tokens["refresh_token"]})
+	expectError(t, rec, http.StatusForbidden, "account has been deactivated")
+
+	expectStatus(t, doRequest(t, http.MethodPost, path+"/activate", admin, nil), http.StatusOK, &got)
+	if !got.IsActive {
+		t.Error("is_active = false after activating")
+	}
+	expectStatus(t, login(), http.StatusOK, nil)
+
+	rec = doRequest(t, http.MethodPost, userPath(user.UserID+1000)+"/deactivate", admin, nil)
+	expectError(t, rec, http.StatusNotFound, "user not found")
+}
+
+func TestLastLoginAt(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	dormant, _ := createTestUser(t, roleUser)
+	recent, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(dormant).UpdateColumn("last_login_at", time.Now().AddDate(0, 0, -100)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": recent.Username, "password": testPassword})
+	expectStatus(t, rec, http.StatusOK, nil)
+	var got Users
+	expectStatus(t, doRequest(t, http.MethodGet, userPath(recent.UserID), "", nil), http.StatusOK, &got)
+	if got.LastLoginAt == nil || time.Since(*got.LastLoginAt) > time.Minute {
+		t.Errorf("last_login_at = %v, want about now", got.LastLoginAt)
+	}
+	if !got.UpdatedAt.Equal(recent.UpdatedAt) {
+		t.Errorf("updated_at moved from %v to %v on login", recent.UpdatedAt, got.UpdatedAt)
+	}
+
+	// The admin has never logged in, so it counts as dormant too.
+	var users []Users
+	expectStatus(t, doRequest(t, http.MethodGet, "/users?inactive_since=90d&sort=user_id", token, nil), http.StatusOK, &users)
+	if len(users) != 2 || users[1].UserID != dormant.UserID {
+		t.Errorf("inactive_since=90d returned %+v, want the admin and user %d", users, dormant.UserID)
+	}
+}
+
+func TestMeRequiresToken(t *testing.T) {
+	expectStatus(t, doRequest(t, http.MethodGet, "/me", "", nil), http.StatusUnauthorized, nil)
+}
+
+func TestRefresh(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	login := func() string {
+		var tokens map[string]string
+		rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+		expectStatus(t, rec, http.StatusOK, &tokens)
+		return tokens["refresh_token"]
+	}
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": token})
+	}
+
+	var tokens map[string]string
+	expectStatus(t, refresh(login()), http.StatusOK, &tokens)
+	if tokens["token"] == "" {
+		t.Error("refresh returned no access token")
+	}
+
+	expired := login()
+	if err := testDB.Model(&RefreshToken{}).Where("token_hash = ?", hashToken(expired)).
+		UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, refresh(expired), http.StatusUnauthorized, "refresh token has expired")
+
+	revoked := login()
+	expectStatus(t, doRequest(t, http.MethodPost, "/logout", "", echo.Map{"refresh_token": revoked}), http.StatusOK, nil)
+	expectError(t, refresh(revoked), http.StatusUnauthorized, "refresh token has been revoked")
+}
+
+func TestSessions(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	_, otherToken := createTestUser(t, roleUser)
+	login := func(agent string) map[string]string {
+		var tokens map[string]string
+		rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword}, "User-Agent", agent)
+		expectStatus(t, rec, http.StatusOK, &tokens)
+		return tokens
+	}
+	laptop := login("laptop")
+	phone := login("phone")
+
+	var sessions []RefreshToken
+	expectStatus(t, doRequest(t, http.MethodGet, "/me/sessions", laptop["token"], nil), http.StatusOK, &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	var phoneSession RefreshToken
+	for _, session := range sessions {
+		if session.UserID != user.UserID {
+			t.Errorf("session %d belongs to user %d", session.ID, session.UserID)
+		}
+		if session.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+	if phoneSession.ID == 0 {
+		t.Fatalf("no session has the phone's user agent: %+v", sessions)
+	}
+
+	path := fmt.Sprintf("/me/sessions/%d", phoneSession.ID)
+	rec := doRequest(t, http.MethodDelete, path, otherToken, nil)
+	expectError(t, rec, http.StatusNotFound, "session not found")
+	expectStatus(t, doRequest(t, http.MethodDelete, path, laptop["token"], nil), http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": phone["refresh_token"]})
+	expectError(t, rec, http.StatusUnauthorized, "refresh token has been revoked")
+	expectStatus(t, doRequest(t, http.MethodGet, "/me/sessions", laptop["token"], nil), http.StatusOK, &sessions)
+	if len(sessions) != 1 {
+		t.Errorf("got %d sessions after revoking one, want 1", len(sessions))
+	}
+
+	rec = doRequest(t, http.MethodDelete, "/me/sessions/abc", laptop["token"], nil)
+	expectError(t, rec, http.StatusBadRequest, "invalid session id")
+}
+
+func TestTokensAreStoredHashed(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	var tokens map[string]string
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	expectStatus(t, rec, http.StatusOK, &tokens)
+	var stored RefreshToken
+	if err := testDB.Where("user_id = ?", user.UserID).First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.TokenHash == tokens["refresh_token"] || stored.TokenHash != hashToken(tokens["refresh_token"]) {
+		t.Errorf("stored refresh token %q, want the hash of %q", stored.TokenHash, tokens["refresh_token"])
+	}
+	// The stored digest is not itself a valid token.
+	rec = doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": stored.TokenHash})
+	expectError(t, rec, http.StatusUnauthorized, "invalid refresh token")
+
+	var created Users
+	rec = doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "pia", "password": testPassword, "email": "pia@example.com"})
+	expectStatus(t, rec, http.StatusCreated, &created)
+	var unverified Users
+	if err := testDB.First(&unverified, created.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if unverified.VerificationTokenHash == nil {
+		t.Fatal("new user has no verification token")
+	}
+	rec = doRequest(t, http.MethodGet, "/users/verify?token="+*unverified.VerificationTokenHash, "", nil)
+	expectError(t, rec, http.StatusBadRequest, "invalid verification token")
+}
+
+func TestFailedLoginKeepsUpdatedAt(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	var before, after Users
+	if err := testDB.First(&before, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "Wr0ng-password"})
+	expectStatus(t, rec, http.StatusUnauthorized, nil)
+	if err := testDB.First(&after, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if after.FailedLoginCount != 1 || !after.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("failed login count = %d, updated_at %v -> %v; want 1 and unchanged",
+			after.FailedLoginCount, before.UpdatedAt, after.UpdatedAt)
+	}
+}
+
+func TestLockoutAndUnlock(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	login := func(password string) *httptest.ResponseRecorder {
+		return doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": password})
+	}
+
+	for i := 0; i < defaultMaxFailedLogins; i++ {
+		expectStatus(t, login("Wr0ng-password"), http.StatusUnauthorized, nil)
+	}
+	expectStatus(t, login(testPassword), http.StatusLocked, nil)
+
+	// Once the window has passed the right password works again.
+	if err := testDB.Model(user).UpdateColumn("locked_until", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, login(testPassword), http.StatusOK, nil)
+	var stored Users
+	if err := testDB.First(&stored, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailedLoginCount != 0 || stored.LockedUntil != nil {
+		t.Errorf("after unlock: failed login count %d, locked until %v; want both cleared", stored.FailedLoginCount, stored.LockedUntil)
+	}
+}
+
+func TestLockedLoginNeedsRightPassword(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	if err := testDB.Model(user).UpdateColumn("locked_until", time.Now().Add(time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the password the lock is not revealed.
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "Wr0ng-password"})
+	expectStatus(t, rec, http.StatusUnauthorized, nil)
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	expectStatus(t, rec, http.StatusLocked, nil)
+}
+
+func TestPatchRejectsReusedPassword(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID)
+
+	rec := doRequest(t, http.MethodPatch, path, token, echo.Map{"password": "N3w-passw0rd"}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPatch, path, token, echo.Map{"password": testPassword}, "If-Match", strconv.Itoa(user.Version+1))
+	expectStatus(t, rec, http.StatusUnprocessableEntity, nil)
+}
+
+func TestChangePasswordRejectsReuse(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID) + "/change-password"
+	rec := doRequest(t, http.MethodPost, path, token, echo.Map{"current_password": testPassword, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, path, token, echo.Map{"current_password": "N3w-passw0rd", "new_password": testPassword})
+	expectError(t, rec, http.StatusUnprocessableEntity, passwordReusedMessage)
+}
+
+func TestPasswordHistoryIsTrimmed(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	repo := NewUserRepository(testDB)
+	for i := 1; i <= 4; i++ {
+		if err := repo.AddPasswordHistory(&PasswordHistory{UserID: user.UserID, PasswordHash: "hash" + strconv.Itoa(i)}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes, err := repo.RecentPasswordHashes(user.UserID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(hashes) != "[hash4 hash3]" {
+		t.Errorf("history = %v, want only the two newest hashes", hashes)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	path := userPath(user.UserID) + "/change-password"
+
+	rec := doRequest(t, http.MethodPost, path, token, echo.Map{"current_password": "Wr0ng-password", "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusUnauthorized, nil)
+	var stored Users
+	if err := testDB.First(&stored, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailedLoginCount != 1 {
+		t.Errorf("failed login count = %d, want 1", stored.FailedLoginCount)
+	}
+
+	rec = doRequest(t, http.MethodPost, path, token, echo.Map{"current_password": testPassword, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+	expectUpdateRecorded(t, user.UserID, "password")
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+}
+
+func TestChangingAnotherUsersPasswordIsForbidden(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleUser)
+	other, _ := createTestUser(t, roleUser)
+	rec := doRequest(t, http.MethodPost, userPath(other.UserID)+"/change-password", token,
+		echo.Map{"current_password": testPassword, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusForbidden, nil)
+}
+
+// createResetToken stores a password reset token for userID expiring at
+// expires and returns the raw token.
+func createResetToken(t *testing.T, userID int, expires time.Time) string {
+	t.Helper()
+	token, err := randomToken(resetTokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Create(&PasswordResetToken{TokenHash: hashToken(token), UserID: userID, ExpiresAt: expires}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPasswordReset(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+
+	var tokens map[string]string
+	rec := doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": testPassword})
+	expectStatus(t, rec, http.StatusOK, &tokens)
+
+	rec = doRequest(t, http.MethodPost, "/password-reset/request", "", echo.Map{"email": "nobody@example.com"})
+	expectStatus(t, rec, http.StatusOK, nil)
+
+	reset := createResetToken(t, user.UserID, time.Now().Add(time.Hour))
+	rec = doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+	expectUpdateRecorded(t, user.UserID, "password")
+
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, "/refresh", "", echo.Map{"refresh_token": tokens["refresh_token"]})
+	expectStatus(t, rec, http.StatusUnauthorized, nil)
+}
+
+func TestPasswordResetExpiredToken(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	reset := createResetToken(t, user.UserID, time.Now().Add(-time.Minute))
+	rec := doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestPasswordResetReusedToken(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	reset := createResetToken(t, user.UserID, time.Now().Add(time.Hour))
+	rec := doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset, "new_password": "N3w-passw0rd"})
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, "/password-reset/confirm", "", echo.Map{"token": reset, "new_password": "An0ther-passw0rd"})
+	expectStatus(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestPasswordResetRequest(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+
+	var known, unknown map[string]string
+	rec := doRequest(t, http.MethodPost, "/password-reset/request", "", echo.Map{"email": user.Email})
+	expectStatus(t, rec, http.StatusOK, &known)
+	rec = doRequest(t, http.MethodPost, "/password-reset/request", "", echo.Map{"email": "nobody@example.com"})
+	expectStatus(t, rec, http.StatusOK, &unknown)
+	if known["message"] != unknown["message"] {
+		t.Errorf("messages differ: %q for a known email, %q for an unknown one", known["message"], unknown["message"])
+	}
+
+	var resets []PasswordResetToken
+	if err := testDB.Where("user_id = ?", user.UserID).Find(&resets).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(resets) != 1 || !resets[0].ExpiresAt.After(time.Now()) {
+		t.Errorf("reset tokens = %+v, want one that has not expired", resets)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	requireDB(t)
+	admin, token := createTestUser(t, roleAdmin)
+	user, userToken := createTestUser(t, roleUser)
+	path := fmt.Sprintf("/users/batch?ids=%d,%d,%d", admin.UserID, user.UserID, user.UserID+1000)
+
+	expectStatus(t, doRequest(t, http.MethodGet, path, "", nil), http.StatusUnauthorized, nil)
+	expectStatus(t, doRequest(t, http.MethodGet, path, userToken, nil), http.StatusForbidden, nil)
+
+	var byID map[string]Users
+	expectStatus(t, doRequest(t, http.MethodGet, path, token, nil), http.StatusOK, &byID)
+	if len(byID) != 2 || byID[strconv.Itoa(user.UserID)].Username != user.Username {
+		t.Errorf("got %v, want users %d and %d only", byID, admin.UserID, user.UserID)
+	}
+}
+
+func TestBatchRejectsBadIDs(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleAdmin}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, maxBatchIDs+1)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	for query, msg := range map[string]string{
+		"":                               "ids is required",
+		"?ids=,,":                        "ids is required",
+		"?ids=1,two":                     "invalid id: two",
+		"?ids=" + strings.Join(ids, ","): "at most " + strconv.Itoa(maxBatchIDs) + " ids are allowed",
+	} {
+		expectError(t, doRequest(t, http.MethodGet, "/users/batch"+query, token, nil), http.StatusBadRequest, msg)
+	}
+}
+
+func TestBulkUpdateRejectsBadRequests(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleAdmin}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, maxBatchIDs+1)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	for _, tc := range []struct {
+		body echo.Map
+		msg  string
+	}{
+		{echo.Map{"patch": echo.Map{"is_active": false}}, "ids is required"},
+		{echo.Map{"ids": ids, "patch": echo.Map{"is_active": false}}, "at most " + strconv.Itoa(maxBatchIDs) + " ids are allowed"},
+		{echo.Map{"ids": []int{1}, "patch": echo.Map{"email": "x@example.com"}}, "patch must set is_active or role"},
+	} {
+		expectError(t, doRequest(t, http.MethodPatch, "/users/bulk", token, tc.body), http.StatusBadRequest, tc.msg)
+	}
+	rec := doRequest(t, http.MethodPatch, "/users/bulk", token, echo.Map{"ids": []int{1}, "patch": echo.Map{"role": "root"}})
+	expectStatus(t, rec, http.StatusUnprocessableEntity, nil)
+}
+
+func TestEnrollMFAWithoutKey(t *testing.T) {
+	token, err := generateToken(Users{UserID: 1, Role: roleUser}, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, doRequest(t, http.MethodPost, "/me/mfa/enroll", token, nil), http.StatusServiceUnavailable, nil)
+}
+
+func TestMFAStepIsUsedOnce(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	users := NewUserRepository(testDB)
+	for _, tc := range []struct {
+		step int64
+		want bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		ok, err := users.UseMFAStep(user, tc.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.want {
+			t.Errorf("UseMFAStep(%d) = %v, want %v", tc.step, ok, tc.want)
+		}
+	}
+}
+
+func TestMFACodeIsSingleUse(t *testing.T) {
+	requireDB(t)
+	user, _ := createTestUser(t, roleUser)
+	h := NewUserHandler(&Config{MFAEncryptionKey: "test-key"}, NewUserRepository(testDB), nil, nil, nil, nil)
+	const secret = "JBSWY3DPEHPK3PXP"
+	encrypted, err := h.encryptMFASecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.MFASecret = &encrypted
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testServer.NewContext(httptest.NewRequest(http.MethodPost, "/login", nil), httptest.NewRecorder())
+	for i, want := range []bool{true, false} {
+		ok, err := h.validMFACode(c, user, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("attempt %d: validMFACode() = %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+func TestPhoneVerification(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	expectError(t, doRequest(t, http.MethodPost, "/me/phone/verify/request", token, nil), http.StatusBadRequest, "user has no phone number")
+	if err := testDB.Model(user).UpdateColumn("phone", "+14155550123").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	expectStatus(t, doRequest(t, http.MethodPost, "/me/phone/verify/request", token, nil), http.StatusOK, nil)
+	var stored Users
+	if err := testDB.First(&stored, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.PhoneOTPHash == nil || stored.PhoneOTPExpiresAt == nil || !stored.PhoneOTPExpiresAt.After(time.Now()) {
+		t.Fatalf("stored %v expiring %v, want a hashed code that has not expired", stored.PhoneOTPHash, stored.PhoneOTPExpiresAt)
+	}
+	// The code only goes out by SMS, so swap in one the test knows.
+	hash, err := bcrypt.GenerateFromPassword([]byte("654321"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.Model(user).UpdateColumn("phone_otp_hash", string(hash)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var verified Users
+	expectStatus(t, doRequest(t, http.MethodPost, "/me/phone/verify/confirm", token, echo.Map{"code": "654321"}), http.StatusOK, &verified)
+	if !verified.PhoneVerified {
+		t.Fatal("phone is not verified after the right code")
+	}
+	expectError(t, doRequest(t, http.MethodPost, "/me/phone/verify/request", token, nil), http.StatusConflict, "phone is already verified")
+
+	rec := doRequest(t, http.MethodPatch, "/me", token, echo.Map{"phone": "+14155550199"}, "If-Match", strconv.Itoa(verified.Version))
+	expectStatus(t, rec, http.StatusOK, &verified)
+	if verified.PhoneVerified {
+		t.Error("phone is still verified after changing it")
+	}
+}
+
+func TestPhoneCodeAttemptsAreLimited(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	hash, err := bcrypt.GenerateFromPassword([]byte("123456"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testDB.Model(user).UpdateColumns(map[string]interface{}{
+		"phone_otp_hash":       string(hash),
+		"phone_otp_expires_at": time.Now().Add(time.Hour),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxPhoneOTPAttempts; i++ {
+		rec := doRequest(t, http.MethodPost, "/me/phone/verify/confirm", token, echo.Map{"code": "000000"})
+		expectStatus(t, rec, http.StatusBadRequest, nil)
+	}
+	// The right code no longer helps once the guesses are spent.
+	rec := doRequest(t, http.MethodPost, "/me/phone/verify/confirm", token, echo.Map{"code": "123456"})
+	expectStatus(t, rec, http.StatusBadRequest, nil)
+	var stored Users
+	if err := testDB.First(&stored, user.UserID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.PhoneOTPAttempts != maxPhoneOTPAttempts || stored.PhoneVerified {
+		t.Errorf("attempts = %d, verified = %v; want %d and false", stored.PhoneOTPAttempts, stored.PhoneVerified, maxPhoneOTPAttempts)
+	}
+}
+
+// expectStoredPassword fails t unless userID's stored password is a bcrypt
+// hash of password.
+func expectStoredPassword(t *testing.T, userID int, password string) {
+	t.Helper()
+	var stored Users
+	if err := testDB.First(&stored, userID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte(password)); err != nil {
+		t.Errorf("stored password %q is not a hash of %q: %v", stored.Password, password, err)
+	}
+}
+
+func TestPasswordsAreStoredHashed(t *testing.T) {
+	requireDB(t)
+	_, token := createTestUser(t, roleAdmin)
+	var user Users
+	rec := doRequest(t, http.MethodPost, "/users", token, echo.Map{"username": "hank", "password": testPassword, "email": "hank@example.com"})
+	expectStatus(t, rec, http.StatusCreated, &user)
+	expectStoredPassword(t, user.UserID, testPassword)
+
+	rec = doRequest(t, http.MethodPut, userPath(user.UserID), token, echo.Map{
+		"username": user.Username,
+		"password": "Put-passw0rd",
+		"email":    user.Email,
+		"version":  user.Version,
+	})
+	expectStatus(t, rec, http.StatusOK, &user)
+	expectStoredPassword(t, user.UserID, "Put-passw0rd")
+
+	rec = doRequest(t, http.MethodPatch, userPath(user.UserID), token, echo.Map{"password": "Patch-passw0rd"}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, nil)
+	expectStoredPassword(t, user.UserID, "Patch-passw0rd")
+
+	rec = doRequest(t, http.MethodPost, userPath(user.UserID)+"/change-password", token, echo.Map{
+		"current_password": "Patch-passw0rd",
+		"new_password":     "Changed-passw0rd1",
+	})
+	expectStatus(t, rec, http.StatusOK, nil)
+	expectStoredPassword(t, user.UserID, "Changed-passw0rd1")
+}
+
+func TestSeed(t *testing.T) {
+	requireDB(t)
+	count := func() int64 {
+		var n int64
+		if err := testDB.Model(&Users{}).Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	logs := observeLogs(t, zapcore.InfoLevel)
+	if err := runSeed(testDB, bcrypt.MinCost, []string{"-n", "0"}); err == nil {
+		t.Error("seeding 0 users succeeded")
+	}
+	for _, tc := range []struct {
+		args []string
+		want int64
+	}{
+		{[]string{"-n", "5", "-password", testPassword}, 5},
+		{[]string{"-n", "5"}, 5},
+		{[]string{"-n", "3", "-force"}, 8},
+	} {
+		if err := runSeed(testDB, bcrypt.MinCost, tc.args); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(); n != tc.want {
+			t.Errorf("after seed %v: %d users, want %d", tc.args, n, tc.want)
+		}
+	}
+
+	var seeded Users
+	if err := testDB.Order("user_id").First(&seeded).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(seeded.Password), []byte(testPassword)); err != nil {
+		t.Errorf("seeded user's password is not a hash of -password: %v", err)
+	}
+	for _, entry := range logs.All() {
+		for _, field := range entry.Context {
+			if field.String == testPassword {
+				t.Errorf("%q logs the seed password as %s", entry.Message, field.Key)
+			}
+		}
+	}
+}
+
+func TestHashLookingPasswordIsHashed(t *testing.T) {
+	requireDB(t)
+	user, token := createTestUser(t, roleUser)
+	// A password that happens to be a valid bcrypt hash is still only a
+	// password.
+	hash, err := bcrypt.GenerateFromPassword([]byte("anything"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := string(hash)
+	rec := doRequest(t, http.MethodPatch, userPath(user.UserID), token, echo.Map{"password": password}, "If-Match", strconv.Itoa(user.Version))
+	expectStatus(t, rec, http.StatusOK, nil)
+	rec = doRequest(t, http.MethodPost, "/login", "", echo.Map{"username": user.Username, "password": password})
+	expectStatus(t, rec, http.StatusOK, nil)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo-contrib/prometheus"
+	"github.com/labstack/echo/v4"
+	client "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"time"
+)
+
+var usersTotal = promauto.NewGauge(client.GaugeOpts{
+	Namespace: "ums",
+	Name:      "users_total",
+	Help:      "Number of users that have not been deleted.",
+})
+
+// setupMetrics instruments every request and serves the metrics at path.
+func setupMetrics(e *echo.Echo, path string) {
+	p := prometheus.NewPrometheus("ums", nil)
+	p.MetricsPath = path
+	p.Use(e)
+}
+
+// refreshUserCount keeps usersTotal up to date, recounting every interval
+// until ctx is cancelled.
+func refreshUserCount(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var total int64
+		if err := db.WithContext(ctx).Model(&Users{}).Count(&total).Error; err != nil {
+			zap.L().Error("refreshing user count", zap.Error(err))
+		} else {
+			usersTotal.Set(float64(total))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	mfaIssuer = "UMS"
+	// mfaPeriod is the TOTP time step; codes from one step either side of
+	// the current one are accepted to allow for clock drift.
+	mfaPeriod = 30
+)
+
+var errMFANotConfigured = errors.New("mfa is not configured")
+
+// mfaCipher returns an AES-256-GCM cipher keyed from MFA_ENCRYPTION_KEY, which
+// protects TOTP secrets at rest.
+func (h *UserHandler) mfaCipher() (cipher.AEAD, error) {
+	secret := h.cfg.MFAEncryptionKey
+	if secret == "" {
+		return nil, errMFANotConfigured
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptMFASecret seals secret under a random nonce, returning
+// base64(nonce || ciphertext).
+func (h *UserHandler) encryptMFASecret(secret string) (string, error) {
+	gcm, err := h.mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (h *UserHandler) decryptMFASecret(encrypted string) (string, error) {
+	gcm, err := h.mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("mfa secret is malformed")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// checkMFAKey refuses to start without MFA_ENCRYPTION_KEY once any user has a
+// TOTP secret, which could otherwise never be decrypted.
+func checkMFAKey(db *gorm.DB, cfg *Config) error {
+	if cfg.MFAEncryptionKey != "" {
+		return nil
+	}
+	var enrolled int64
+	if err := db.Model(&Users{}).Where("mfa_secret IS NOT NULL").Count(&enrolled).Error; err != nil {
+		return err
+	}
+	if enrolled > 0 {
+		return fmt.Errorf("MFA_ENCRYPTION_KEY is required: %d users have enrolled in mfa", enrolled)
+	}
+	return nil
+}
+
+// validMFACode reports whether code is a current TOTP code for user. Each time
+// step is accepted once, so a code seen in transit cannot be replayed.
+func (h *UserHandler) validMFACode(c echo.Context, user *Users, code string) (bool, error) {
+	if user.MFASecret == nil {
+		return false, nil
+	}
+	secret, err := h.decryptMFASecret(*user.MFASecret)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().Unix() / mfaPeriod
+	for step := now - 1; step <= now+1; step++ {
+		want, err := totp.GenerateCode(secret, time.Unix(step*mfaPeriod, 0))
+		if err != nil {
+			return false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			return h.users(c).UseMFAStep(user, step)
+		}
+	}
+	return false, nil
+}
+
+// respondMFAError answers an error from validMFACode, reporting a missing
+// MFA_ENCRYPTION_KEY as 503 rather than as a fault in the request.
+func respondMFAError(c echo.Context, err error) error {
+	if errors.Is(err, errMFANotConfigured) {
+		return respondError(c, http.StatusServiceUnavailable, err.Error())
+	}
+	return respondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// EnrollMFA generates a new TOTP secret for the caller. MFA stays off until the
+// first code is confirmed with VerifyMFA, and enrolling again before then
+// replaces the pending secret.
+// @Summary Start TOTP enrollment
+// @Tags me
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} SuccessResponse{data=MFAEnrollment}
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /me/mfa/enroll [post]
+func (h *UserHandler) EnrollMFA(c echo.Context) error {
+	if h.cfg.MFAEncryptionKey == "" {
+		return respondError(c, http.StatusServiceUnavailable, errMFANotConfigured.Error())
+	}
+	user, err := h.users(c).FindByID(currentUserID(c))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.MFAEnabled {
+		return respondError(c, http.StatusConflict, "mfa is already enabled")
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: mfaIssuer, AccountName: user.Email})
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	encrypted, err := h.encryptMFASecret(key.Secret())
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	img, err := key.Image(mfaQRCodeSize, mfaQRCodeSize)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	user.MFASecret = &encrypted
+	if err := h.users(c).SaveMFA(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, MFAEnrollment{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: base64.StdEncoding.EncodeToString(qr.Bytes()),
+	}, nil)
+}
+
+// @Summary Confirm TOTP enrollment
+// @Tags me
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body MFACodeRequest true "Current TOTP code"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Router /me/mfa/verify [post]
+func (h *UserHandler) VerifyMFA(c echo.Context) error {
+	var request MFACodeRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	user, err := h.users(c).FindByID(currentUserID(c))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.MFAEnabled {
+		return respondError(c, http.StatusConflict, "mfa is already enabled")
+	}
+	if user.MFASecret == nil {
+		return respondError(c, http.StatusBadRequest, "mfa enrollment has not been started")
+	}
+	ok, err := h.validMFACode(c, user, request.Code)
+	if err != nil {
+		return respondMFAError(c, err)
+	}
+	if !ok {
+		return respondError(c, http.StatusBadRequest, "invalid mfa code")
+	}
+	user.MFAEnabled = true
+	if err := h.users(c).SaveMFA(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, user, nil)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"github.com/pquerna/otp/totp"
+	"testing"
+	"time"
+)
+
+func TestMFASecretEncryption(t *testing.T) {
+	h := &UserHandler{cfg: &Config{MFAEncryptionKey: "key-one"}}
+	first, err := h.encryptMFASecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.encryptMFASecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("encrypting twice gave the same ciphertext")
+	}
+	if secret, err := h.decryptMFASecret(first); err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("decryptMFASecret() = %q, %v; want the original secret", secret, err)
+	}
+
+	other := &UserHandler{cfg: &Config{MFAEncryptionKey: "key-two"}}
+	if _, err := other.decryptMFASecret(first); err == nil {
+		t.Error("a different key decrypted the secret")
+	}
+	unset := &UserHandler{cfg: &Config{}}
+	if _, err := unset.encryptMFASecret("JBSWY3DPEHPK3PXP"); !errors.Is(err, errMFANotConfigured) {
+		t.Errorf("encrypting without a key = %v, want %v", err, errMFANotConfigured)
+	}
+}
+
+// Codes outside the accepted window are rejected before the database is
+// consulted.
+func TestValidMFACodeWindow(t *testing.T) {
+	h := &UserHandler{cfg: &Config{MFAEncryptionKey: "key-one"}}
+	if ok, err := h.validMFACode(nil, &Users{}, "123456"); ok || err != nil {
+		t.Errorf("without a secret: %v, %v; want false", ok, err)
+	}
+	const secret = "JBSWY3DPEHPK3PXP"
+	encrypted, err := h.encryptMFASecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := totp.GenerateCode(secret, time.Now().Add(-5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := h.validMFACode(nil, &Users{MFASecret: &encrypted}, stale); ok || err != nil {
+		t.Errorf("a five-minute-old code: %v, %v; want false", ok, err)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// migrations lists every schema change in the order it is applied. Each one
+// declares its own copy of the models it touches, so later changes to the
+// structs in main.go never rewrite history. Append new migrations; never edit
+// one that has shipped.
+var migrations = []*gormigrate.Migration{
+	{
+		// Creates the schema as AutoMigrate last left it, so databases that
+		// were managed by AutoMigrate adopt it without changes.
+		ID: "202610140001_initial",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				UserID            int    `gorm:"primaryKey;autoIncrement"`
+				Username          string `gorm:"unique"`
+				Password          string
+				FirstName         string
+				LastName          string
+				Phone             string `gorm:"unique"`
+				Email             string `gorm:"unique"`
+				Birthday          *time.Time
+				IsActive          bool    `gorm:"default:false"`
+				Role              string  `gorm:"default:user"`
+				VerificationToken *string `gorm:"index"`
+				FailedLoginCount  int     `gorm:"default:0"`
+				LockedUntil       *time.Time
+				AvatarURL         *string
+				CreatedAt         time.Time
+				UpdatedAt         time.Time
+				DeletedAt         gorm.DeletedAt `gorm:"index"`
+			}
+			type RefreshToken struct {
+				ID        int    `gorm:"primaryKey;autoIncrement"`
+				Token     string `gorm:"uniqueIndex"`
+				UserID    int    `gorm:"index"`
+				ExpiresAt time.Time
+				Revoked   bool `gorm:"default:false"`
+				CreatedAt time.Time
+			}
+			type PasswordResetToken struct {
+				ID        int    `gorm:"primaryKey;autoIncrement"`
+				TokenHash string `gorm:"uniqueIndex"`
+				UserID    int    `gorm:"index"`
+				ExpiresAt time.Time
+				UsedAt    *time.Time
+				CreatedAt time.Time
+			}
+			type IdempotencyKey struct {
+				ID          int    `gorm:"primaryKey;autoIncrement"`
+				Key         string `gorm:"uniqueIndex:idx_idempotency_caller_key"`
+				CallerID    string `gorm:"uniqueIndex:idx_idempotency_caller_key"`
+				RequestHash string
+				StatusCode  int
+				Response    []byte
+				CreatedAt   time.Time
+			}
+			return tx.AutoMigrate(&Users{}, &RefreshToken{}, &PasswordResetToken{}, &IdempotencyKey{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("idempotency_keys", "password_reset_tokens", "refresh_tokens", "users")
+		},
+	},
+	{
+		// Birthday used to be NOT NULL, so rows from before it became optional
+		// hold the zero date instead of NULL.
+		ID: "202610140002_null_zero_birthdays",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Exec("UPDATE users SET birthday = NULL WHERE birthday = '0001-01-01'").Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return nil
+		},
+	},
+	{
+		ID: "202610140003_users_last_login_at",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				LastLoginAt *time.Time
+			}
+			return tx.Migrator().AddColumn(&Users{}, "LastLoginAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "last_login_at")
+		},
+	},
+	{
+		ID: "202610140004_user_audits",
+		Migrate: func(tx *gorm.DB) error {
+			type UserAudit struct {
+				ID        int `gorm:"primaryKey;autoIncrement"`
+				UserID    int `gorm:"index"`
+				ActorID   *int
+				Action    string
+				Changes   string `gorm:"type:jsonb"`
+				CreatedAt time.Time
+			}
+			return tx.AutoMigrate(&UserAudit{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("user_audits")
+		},
+	},
+	{
+		ID: "202610140005_users_version",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				Version int `gorm:"not null;default:0"`
+			}
+			return tx.Migrator().AddColumn(&Users{}, "Version")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "version")
+		},
+	},
+	{
+		ID: "202610140006_users_phone_verification",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				PhoneVerified     bool `gorm:"not null;default:false"`
+				PhoneOTPHash      *string
+				PhoneOTPExpiresAt *time.Time
+				PhoneOTPAttempts  int `gorm:"not null;default:0"`
+			}
+			for _, field := range []string{"PhoneVerified", "PhoneOTPHash", "PhoneOTPExpiresAt", "PhoneOTPAttempts"} {
+				if err := tx.Migrator().AddColumn(&Users{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "phone_verified", "phone_otp_hash", "phone_otp_expires_at", "phone_otp_attempts")
+		},
+	},
+	{
+		ID: "202610140007_users_mfa",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				MFAEnabled bool `gorm:"not null;default:false"`
+				MFASecret  *string
+			}
+			for _, field := range []string{"MFAEnabled", "MFASecret"} {
+				if err := tx.Migrator().AddColumn(&Users{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "mfa_enabled", "mfa_secret")
+		},
+	},
+	{
+		ID: "202610140008_password_histories",
+		Migrate: func(tx *gorm.DB) error {
+			type PasswordHistory struct {
+				ID           int `gorm:"primaryKey;autoIncrement"`
+				UserID       int `gorm:"index"`
+				PasswordHash string
+				CreatedAt    time.Time
+			}
+			return tx.AutoMigrate(&PasswordHistory{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("password_histories")
+		},
+	},
+	{
+		ID: "202610140009_outbox_events",
+		Migrate: func(tx *gorm.DB) error {
+			type OutboxEvent struct {
+				ID          int `gorm:"primaryKey;autoIncrement"`
+				Type        string
+				UserID      int
+				OccurredAt  time.Time
+				PublishedAt *time.Time `gorm:"index"`
+			}
+			return tx.AutoMigrate(&OutboxEvent{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("outbox_events")
+		},
+	},
+	{
+		// Phone became optional. The column was always nullable, so only
+		// empty strings, which collide on the unique index, need rewriting.
+		// There is no rollback, since several NULLs cannot go back to "".
+		ID: "202610140010_users_phone_nullable",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Exec("UPDATE users SET phone = NULL WHERE phone = ''").Error
+		},
+	},
+	{
+		ID: "202610140011_refresh_tokens_client",
+		Migrate: func(tx *gorm.DB) error {
+			type RefreshToken struct {
+				UserAgent string
+				IP        string
+			}
+			for _, field := range []string{"UserAgent", "IP"} {
+				if err := tx.Migrator().AddColumn(&RefreshToken{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "refresh_tokens", "user_agent", "ip")
+		},
+	},
+	{
+		ID: "202610140012_users_timezone",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				Timezone string `gorm:"not null;default:UTC"`
+			}
+			return tx.Migrator().AddColumn(&Users{}, "Timezone")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "timezone")
+		},
+	},
+	{
+		// Hashing is one-way, so there is no rollback. Tokens already handed out
+		// keep working as they hash to the stored value.
+		ID: "202610140013_hash_tokens",
+		Migrate: func(tx *gorm.DB) error {
+			for _, t := range []struct{ table, column string }{
+				{"users", "verification_token"},
+				{"refresh_tokens", "token"},
+			} {
+				hashed := t.column + "_hash"
+				for _, stmt := range []string{
+					"ALTER TABLE " + t.table + " RENAME COLUMN " + t.column + " TO " + hashed,
+					"ALTER INDEX idx_" + t.table + "_" + t.column + " RENAME TO idx_" + t.table + "_" + hashed,
+					"UPDATE " + t.table + " SET " + hashed + " = encode(sha256(convert_to(" + hashed + ", 'UTF8')), 'hex') WHERE " + hashed + " IS NOT NULL",
+				} {
+					if err := tx.Exec(stmt).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// Generated columns need Postgres 12. Older servers skip this and
+		// Search keeps using ILIKE.
+		ID: "202610140014_users_search_vector",
+		Migrate: func(tx *gorm.DB) error {
+			var version int
+			if err := tx.Raw("SELECT current_setting('server_version_num')::int").Scan(&version).Error; err != nil {
+				return err
+			}
+			if version < 120000 {
+				zap.L().Warn("postgres is older than 12, full-text user search is disabled", zap.Int("server_version_num", version))
+				return nil
+			}
+			for _, stmt := range []string{
+				`ALTER TABLE users ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+					setweight(to_tsvector('simple', coalesce(username, '')), 'A') ||
+					setweight(to_tsvector('simple', coalesce(first_name, '') || ' ' || coalesce(last_name, '')), 'B') ||
+					setweight(to_tsvector('simple', coalesce(email, '')), 'C')
+				) STORED`,
+				"CREATE INDEX idx_users_search_vector ON users USING GIN (search_vector)",
+			} {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE users DROP COLUMN IF EXISTS search_vector").Error
+		},
+	},
+	{
+		ID: "202610140015_webhooks",
+		Migrate: func(tx *gorm.DB) error {
+			type Webhook struct {
+				ID        int `gorm:"primaryKey;autoIncrement"`
+				URL       string
+				Secret    string
+				Events    string `gorm:"type:jsonb"`
+				Active    bool   `gorm:"default:true"`
+				CreatedAt time.Time
+				UpdatedAt time.Time
+			}
+			type WebhookDelivery struct {
+				ID            int     `gorm:"primaryKey;autoIncrement"`
+				WebhookID     int     `gorm:"index"`
+				Webhook       Webhook `gorm:"constraint:OnDelete:CASCADE"`
+				EventType     string
+				UserID        int
+				OccurredAt    time.Time
+				Attempts      int       `gorm:"default:0"`
+				NextAttemptAt time.Time `gorm:"index"`
+				LastError     string
+				DeliveredAt   *time.Time
+				FailedAt      *time.Time
+				CreatedAt     time.Time
+			}
+			return tx.AutoMigrate(&Webhook{}, &WebhookDelivery{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("webhook_deliveries", "webhooks")
+		},
+	},
+	{
+		// Replaces the unique constraints Postgres named users_<column>_key
+		// with indexes named after the columns, so scoping them later, say by
+		// tenant, is a matter of adding a column to the index. Each index is
+		// built before its constraint goes, so uniqueness never lapses.
+		ID: "202610140016_users_named_unique_indexes",
+		Migrate: func(tx *gorm.DB) error {
+			for _, column := range []string{"username", "email", "phone"} {
+				for _, stmt := range []string{
+					"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_" + column + " ON users (" + column + ")",
+					"ALTER TABLE users DROP CONSTRAINT IF EXISTS users_" + column + "_key",
+				} {
+					if err := tx.Exec(stmt).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, column := range []string{"username", "email", "phone"} {
+				stmt := "ALTER TABLE users ADD CONSTRAINT users_" + column + "_key UNIQUE USING INDEX idx_users_" + column
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "202610140017_users_mfa_last_step",
+		Migrate: func(tx *gorm.DB) error {
+			type Users struct {
+				MFALastStep *int64
+			}
+			return tx.Migrator().AddColumn(&Users{}, "MFALastStep")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropColumns(tx, "users", "mfa_last_step")
+		},
+	},
+}
+
+// dropColumns drops columns from table for rollbacks. Migrator().DropColumn
+// cannot be used with a bare table name: it resolves the column through the
+// model's schema and panics when there is none.
+func dropColumns(tx *gorm.DB, table string, columns ...string) error {
+	for _, column := range columns {
+		if err := tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: table}, clause.Column{Name: column}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate applies every pending migration.
+func migrate(db *gorm.DB) error {
+	return gormigrate.New(db, gormigrate.DefaultOptions, migrations).Migrate()
+}
+
+// latestMigration is the ID of the newest migration this build knows about.
+func latestMigration() string {
+	return migrations[len(migrations)-1].ID
+}
+
+// appliedMigration returns the ID of the newest migration recorded in the
+// database, or "" when none has run. IDs sort in the order they are applied.
+func appliedMigration(db *gorm.DB) (string, error) {
+	options := gormigrate.DefaultOptions
+	if !db.Migrator().HasTable(options.TableName) {
+		return "", nil
+	}
+	var ids []string
+	err := db.Table(options.TableName).Order(options.IDColumnName+" DESC").Limit(1).
+		Pluck(options.IDColumnName, &ids).Error
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// migrationApplied reports whether the migration with id is recorded in the
+// database. A newer build may have applied later ones as well.
+func migrationApplied(db *gorm.DB, id string) (bool, error) {
+	options := gormigrate.DefaultOptions
+	if !db.Migrator().HasTable(options.TableName) {
+		return false, nil
+	}
+	var count int64
+	err := db.Table(options.TableName).Where(options.IDColumnName+" = ?", id).Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,12 @@
+package main
+
+import "testing"
+
+// appliedMigration relies on IDs sorting in the order migrations run.
+func TestMigrationIDsAreOrdered(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].ID <= migrations[i-1].ID {
+			t.Errorf("migration %s sorts before %s, which runs earlier", migrations[i].ID, migrations[i-1].ID)
+		}
+	}
+}
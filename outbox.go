@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"time"
+)
+
+// enqueueEvent records a lifecycle event for userID in the outbox through tx,
+// so it commits or rolls back together with the change it describes.
+func enqueueEvent(tx UserRepository, t EventType, userID int) error {
+	return tx.CreateOutboxEvent(&OutboxEvent{Type: t, UserID: userID, OccurredAt: time.Now()})
+}
+
+// relayOutbox hands outbox events to publisher in the order they were
+// written, polling every interval until ctx is cancelled. Delivery is at
+// least once: an event is marked published only after publisher accepts it.
+func relayOutbox(ctx context.Context, outbox OutboxRepository, publisher EventPublisher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// Keep draining while full batches come back.
+		for {
+			n, err := outbox.WithContext(ctx).Relay(outboxBatchSize, func(event OutboxEvent) error {
+				return publisher.Publish(Event{Type: event.Type, UserID: event.UserID, OccurredAt: event.OccurredAt})
+			})
+			if err != nil && ctx.Err() == nil {
+				zap.L().Error("relaying outbox", zap.Int("published", n), zap.Error(err))
+			}
+			if err != nil || n < outboxBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordReusedMessage = "new password must not match a recently used password"
+
+// passwordReused reports whether password matches one of the last
+// PASSWORD_HISTORY_SIZE passwords the user had before their current one.
+func (h *UserHandler) passwordReused(c echo.Context, user *Users, password string) (bool, error) {
+	keep := h.cfg.PasswordHistorySize
+	if keep <= 0 {
+		return false, nil
+	}
+	hashes, err := h.users(c).RecentPasswordHashes(user.UserID, keep)
+	if err != nil {
+		return false, err
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// applyPassword sets the hash of password on user for PUT and PATCH,
+// reporting whether it was rejected as recently used. Resending the current
+// password leaves the stored hash alone.
+func (h *UserHandler) applyPassword(c echo.Context, user *Users, password string) (bool, error) {
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil {
+		return false, nil
+	}
+	reused, err := h.passwordReused(c, user, password)
+	if err != nil || reused {
+		return reused, err
+	}
+	hash, err := hashPassword(password, h.cfg.BcryptCost)
+	if err != nil {
+		return false, err
+	}
+	user.Password = hash
+	return false, nil
+}
+
+// recordPasswordHistory moves before's hash into the password history when
+// user's password has changed since.
+func (h *UserHandler) recordPasswordHistory(tx UserRepository, before, user *Users) error {
+	keep := h.cfg.PasswordHistorySize
+	if keep <= 0 || user.Password == before.Password {
+		return nil
+	}
+	return tx.AddPasswordHistory(&PasswordHistory{UserID: user.UserID, PasswordHash: before.Password}, keep)
+}
+
+// setPassword replaces the user's password within tx, moving the old hash
+// into their password history, and records the change like any other update.
+func (h *UserHandler) setPassword(c echo.Context, tx UserRepository, user *Users, password string) error {
+	before := *user
+	if keep := h.cfg.PasswordHistorySize; keep > 0 {
+		entry := &PasswordHistory{UserID: user.UserID, PasswordHash: user.Password}
+		if err := tx.AddPasswordHistory(entry, keep); err != nil {
+			return err
+		}
+	}
+	hash, err := hashPassword(password, h.cfg.BcryptCost)
+	if err != nil {
+		return err
+	}
+	if err := tx.UpdatePassword(user, hash); err != nil {
+		return err
+	}
+	if err := enqueueEvent(tx, UserUpdated, user.UserID); err != nil {
+		return err
+	}
+	return recordAudit(c, tx, auditUpdate, &before, user)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	passwordResetRequested = "if the email is registered, a reset link has been sent"
+	invalidResetToken      = "invalid or expired reset token"
+)
+
+var errResetTokenUsed = errors.New("reset token already used")
+
+// RequestPasswordReset issues a single-use reset token for the account behind
+// the given email. The response is the same whether or not that account
+// exists, so the endpoint cannot be used to discover registered emails.
+// @Summary Request a password reset
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body PasswordResetRequest true "Account email"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /password-reset/request [post]
+func (h *UserHandler) RequestPasswordReset(c echo.Context) error {
+	var request PasswordResetRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	user, err := h.users(c).FindByEmail(normalizeEmail(request.Email))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondOK(c, http.StatusOK, echo.Map{"message": passwordResetRequested}, nil)
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	token, err := randomToken(resetTokenBytes)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	errCreate := h.passwordResets(c).Create(&PasswordResetToken{
+		TokenHash: hashToken(token),
+		UserID:    user.UserID,
+		ExpiresAt: time.Now().Add(h.cfg.PasswordResetTTL),
+	})
+	if errCreate != nil {
+		return respondError(c, http.StatusInternalServerError, errCreate.Error())
+	}
+	h.sendMail(c, user, "password_reset", passwordResetSubject, token)
+	return respondOK(c, http.StatusOK, echo.Map{"message": passwordResetRequested}, nil)
+}
+
+// ConfirmPasswordReset sets a new password with a reset token and signs the
+// user out everywhere, so whoever prompted the reset loses their session.
+// @Summary Reset a password with a reset token
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body PasswordResetConfirmRequest true "Reset token and new password"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /password-reset/confirm [post]
+func (h *UserHandler) ConfirmPasswordReset(c echo.Context) error {
+	var request PasswordResetConfirmRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	reset, err := h.passwordResets(c).FindByHash(hashToken(request.Token))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusBadRequest, invalidResetToken)
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		return respondError(c, http.StatusBadRequest, invalidResetToken)
+	}
+	user, err := h.users(c).FindByID(strconv.Itoa(reset.UserID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusBadRequest, invalidResetToken)
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	reused := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.NewPassword)) == nil
+	if !reused {
+		if reused, err = h.passwordReused(c, user, request.NewPassword); err != nil {
+			return respondError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+	if reused {
+		return respondError(c, http.StatusUnprocessableEntity, passwordReusedMessage)
+	}
+	errReset := h.users(c).Transaction(func(tx UserRepository) error {
+		claimed, err := tx.ClaimPasswordReset(reset)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return errResetTokenUsed
+		}
+		if err := h.setPassword(c, tx, user, request.NewPassword); err != nil {
+			return err
+		}
+		return tx.RevokeSessions(user.UserID)
+	})
+	if errReset != nil {
+		if errors.Is(errReset, errResetTokenUsed) {
+			return respondError(c, http.StatusBadRequest, invalidResetToken)
+		}
+		return respondError(c, http.StatusInternalServerError, errReset.Error())
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"message": "password updated"}, nil)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+type (
+	// SMSSender delivers a text message to a phone number in E.164 form.
+	SMSSender interface {
+		Send(to, message string) error
+	}
+
+	// logSMSSender writes messages to the log instead of sending them, until
+	// an SMS provider is wired in.
+	logSMSSender struct{}
+)
+
+func (logSMSSender) Send(to, message string) error {
+	zap.L().Info("sms", zap.String("to", to), zap.String("message", message))
+	return nil
+}
+
+// otpCode returns a random zero-padded six-digit code.
+func otpCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// @Summary Send a phone verification code
+// @Tags me
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 429 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me/phone/verify/request [post]
+func (h *UserHandler) RequestPhoneVerification(c echo.Context) error {
+	user, err := h.users(c).FindByID(currentUserID(c))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.Phone == nil {
+		return respondError(c, http.StatusBadRequest, "user has no phone number")
+	}
+	if user.PhoneVerified {
+		return respondError(c, http.StatusConflict, "phone is already verified")
+	}
+	code, err := otpCode()
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(code), h.cfg.BcryptCost)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	hash := string(hashed)
+	expires := time.Now().Add(h.cfg.PhoneOTPTTL)
+	user.PhoneOTPHash = &hash
+	user.PhoneOTPExpiresAt = &expires
+	user.PhoneOTPAttempts = 0
+	if err := h.users(c).SavePhoneVerification(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if err := h.sms.Send(*user.Phone, "Your verification code is "+code); err != nil {
+		return respondError(c, http.StatusBadGateway, "sending verification code failed")
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"message": "verification code sent"}, nil)
+}
+
+// ConfirmPhoneVerification checks the code sent by RequestPhoneVerification.
+// A code is void once it expires or after maxPhoneOTPAttempts wrong guesses.
+// @Summary Confirm a phone verification code
+// @Tags me
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body PhoneVerificationRequest true "Code"
+// @Success 200 {object} SuccessResponse{data=Users}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me/phone/verify/confirm [post]
+func (h *UserHandler) ConfirmPhoneVerification(c echo.Context) error {
+	var request PhoneVerificationRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	user, err := h.users(c).FindByID(currentUserID(c))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "user not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if user.PhoneOTPHash == nil || user.PhoneOTPExpiresAt == nil || time.Now().After(*user.PhoneOTPExpiresAt) {
+		return respondError(c, http.StatusBadRequest, "verification code is invalid or expired")
+	}
+	// The guess is counted before it is checked, so parallel requests
+	// cannot each try a code against the same remaining budget.
+	ok, err := h.users(c).ClaimPhoneOTPAttempt(user, maxPhoneOTPAttempts)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !ok || bcrypt.CompareHashAndPassword([]byte(*user.PhoneOTPHash), []byte(request.Code)) != nil {
+		return respondError(c, http.StatusBadRequest, "verification code is invalid or expired")
+	}
+	user.PhoneVerified = true
+	user.PhoneOTPHash = nil
+	user.PhoneOTPExpiresAt = nil
+	user.PhoneOTPAttempts = 0
+	if err := h.users(c).SavePhoneVerification(user); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, user, nil)
+}
+
+// resetPhoneVerification marks user's phone unverified when it is changing
+// from before's.
+func resetPhoneVerification(tx UserRepository, before, user *Users) error {
+	if stringValue(before.Phone) == stringValue(user.Phone) {
+		return nil
+	}
+	user.PhoneVerified = false
+	user.PhoneOTPHash = nil
+	user.PhoneOTPExpiresAt = nil
+	user.PhoneOTPAttempts = 0
+	return tx.SavePhoneVerification(user)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestOTPCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := otpCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strconv.Atoi(code); len(code) != 6 || err != nil {
+			t.Fatalf("otpCode() = %q, want six digits", code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimiter allows limit requests per window for each identifier returned by
+// identify, answering 429 once the budget is spent.
+func rateLimiter(limit int, window time.Duration, identify middleware.Extractor) echo.MiddlewareFunc {
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(float64(limit) / window.Seconds()),
+		Burst:     limit,
+		ExpiresIn: window,
+	})
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store:               store,
+		IdentifierExtractor: identify,
+		ErrorHandler: func(c echo.Context, err error) error {
+			return respondError(c, http.StatusForbidden, "unable to identify client")
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			return respondError(c, http.StatusTooManyRequests, "too many requests")
+		},
+	})
+}
+
+func clientIP(c echo.Context) (string, error) {
+	return c.RealIP(), nil
+}
+
+// callerID identifies the user of the request's token, so limiters using it
+// must run after jwtAuth.
+func callerID(c echo.Context) (string, error) {
+	id, ok := c.Get("user_id").(int)
+	if !ok {
+		return "", errors.New("request is not authenticated")
+	}
+	return strconv.Itoa(id), nil
+}
+
+func loginRateLimiter(cfg *Config) echo.MiddlewareFunc {
+	return rateLimiter(cfg.LoginRateLimit, cfg.LoginRateWindow, clientIP)
+}
+
+// existsRateLimiter throttles availability checks per client, which would
+// otherwise let anyone enumerate registered usernames and emails.
+func existsRateLimiter(cfg *Config) echo.MiddlewareFunc {
+	return rateLimiter(cfg.ExistsRateLimit, cfg.ExistsRateWindow, clientIP)
+}
+
+// resetRateLimiter throttles password reset requests per client, each of
+// which may send an email to any registered address.
+func resetRateLimiter(cfg *Config) echo.MiddlewareFunc {
+	return rateLimiter(cfg.ResetRateLimit, cfg.ResetRateWindow, clientIP)
+}
+
+// phoneRateLimiter throttles verification code requests per user, each of
+// which sends a text message that costs money and may be used to pester the
+// number's owner.
+func phoneRateLimiter(cfg *Config) echo.MiddlewareFunc {
+	return rateLimiter(cfg.PhoneRateLimit, cfg.PhoneRateWindow, callerID)
+}
+
+// profileRateLimiter throttles profile and password changes per user, however
+// many addresses they come from. The routes using it share one budget.
+func profileRateLimiter(cfg *Config) echo.MiddlewareFunc {
+	return rateLimiter(cfg.ProfileRateLimit, cfg.ProfileRateWindow, callerID)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// limitedStatuses sends n requests through limiter from one client and
+// returns their status codes.
+func limitedStatuses(limiter echo.MiddlewareFunc, n int, setup func(c echo.Context)) []int {
+	e := echo.New()
+	handler := limiter(func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	codes := make([]int, n)
+	for i := range codes {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+		if setup != nil {
+			setup(c)
+		}
+		if err := handler(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		codes[i] = rec.Code
+	}
+	return codes
+}
+
+func TestLoginRateLimiter(t *testing.T) {
+	cfg := &Config{LoginRateLimit: defaultLoginRateLimit, LoginRateWindow: time.Minute}
+	codes := limitedStatuses(loginRateLimiter(cfg), defaultLoginRateLimit+1, nil)
+	for i, code := range codes {
+		want := http.StatusOK
+		if i == defaultLoginRateLimit {
+			want = http.StatusTooManyRequests
+		}
+		if code != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, code, want)
+		}
+	}
+}
+
+func TestExistsRateLimiter(t *testing.T) {
+	cfg := &Config{ExistsRateLimit: 2, ExistsRateWindow: time.Minute}
+	codes := limitedStatuses(existsRateLimiter(cfg), 3, nil)
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses = %v, want two OKs then 429", codes)
+	}
+}
+
+func TestProfileRateLimiter(t *testing.T) {
+	cfg := &Config{ProfileRateLimit: 2, ProfileRateWindow: time.Minute}
+	callers := []int{1, 1, 1, 2}
+	i := 0
+	setup := func(c echo.Context) {
+		// Each request comes from a new address, which must not reset the
+		// caller's budget.
+		c.Request().RemoteAddr = "192.0.2." + strconv.Itoa(i+1) + ":1234"
+		c.Set("user_id", callers[i])
+		i++
+	}
+	codes := limitedStatuses(profileRateLimiter(cfg), len(callers), setup)
+	want := []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("statuses = %v, want %v", codes, want)
+			break
+		}
+	}
+
+	codes = limitedStatuses(profileRateLimiter(cfg), 1, nil)
+	if codes[0] != http.StatusForbidden {
+		t.Errorf("unauthenticated request got %d, want 403", codes[0])
+	}
+}
@@ -0,0 +1,841 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+var errVersionConflict = errors.New("user was modified by another request")
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+type (
+	UserRepository interface {
+		WithContext(ctx context.Context) UserRepository
+		Transaction(fn func(tx UserRepository) error) error
+		Create(user *Users) error
+		FindByID(id string, fields ...string) (*Users, error)
+		FindByIDs(ids []int) ([]Users, error)
+		FindAll(opts UserListOptions) ([]Users, int64, error)
+		FindAfter(after *UserCursor, opts UserListOptions) ([]Users, error)
+		Search(q string, opts UserListOptions) ([]Users, int64, error)
+		Count(opts UserListOptions) (int64, error)
+		Each(fn func(user *Users) error) error
+		Update(user *Users) error
+		Replace(user *Users) error
+		Delete(user *Users) error
+		DeleteInactiveBefore(cutoff time.Time) ([]Users, error)
+		FindByUsername(username string) (*Users, error)
+		FindByEmail(email string) (*Users, error)
+		FindDeletedByID(id string) (*Users, error)
+		Restore(user *Users) error
+		UpdatePassword(user *Users, hash string) error
+		RecentPasswordHashes(userID, limit int) ([]string, error)
+		AddPasswordHistory(entry *PasswordHistory, keep int) error
+		ClaimPasswordReset(reset *PasswordResetToken) (bool, error)
+		RevokeSessions(userID int) error
+		IsTaken(column, value string, exceptID int) (bool, error)
+		Exists(column, value string) (bool, error)
+		FindByVerificationHash(hash string) (*Users, error)
+		Activate(user *Users) error
+		SaveLoginAttempts(user *Users) error
+		SavePhoneVerification(user *Users) error
+		ClaimPhoneOTPAttempt(user *Users, max int) (bool, error)
+		SaveMFA(user *Users) error
+		UseMFAStep(user *Users, step int64) (bool, error)
+		SetActive(user *Users, active bool) error
+		UpdateColumns(user *Users, columns ...string) error
+		RecordLogin(user *Users) error
+		SetAvatar(user *Users, url *string) error
+		FindIdempotencyKey(callerID, key string) (*IdempotencyKey, error)
+		CreateIdempotencyKey(record *IdempotencyKey) error
+		DeleteIdempotencyKey(record *IdempotencyKey) error
+		CreateAudit(entry *UserAudit) error
+		FindAudits(userID int) ([]UserAudit, error)
+		CreateOutboxEvent(event *OutboxEvent) error
+	}
+
+	// OutboxRepository reads back the events written with CreateOutboxEvent.
+	OutboxRepository interface {
+		WithContext(ctx context.Context) OutboxRepository
+		Relay(limit int, fn func(event OutboxEvent) error) (int, error)
+	}
+
+	WebhookRepository interface {
+		WithContext(ctx context.Context) WebhookRepository
+		Create(hook *Webhook) error
+		FindAll() ([]Webhook, error)
+		FindByID(id string) (*Webhook, error)
+		Replace(hook *Webhook) error
+		Delete(hook *Webhook) error
+		FindDeliveries(webhookID, limit int) ([]WebhookDelivery, error)
+		Enqueue(event Event) error
+		ClaimDue(limit int, lease time.Duration) ([]WebhookDelivery, error)
+		SaveDelivery(delivery *WebhookDelivery) error
+	}
+
+	RefreshTokenRepository interface {
+		WithContext(ctx context.Context) RefreshTokenRepository
+		Create(token *RefreshToken) error
+		FindByHash(hash string) (*RefreshToken, error)
+		FindActiveByUser(userID int) ([]RefreshToken, error)
+		FindByIDForUser(id, userID int) (*RefreshToken, error)
+		Revoke(token *RefreshToken) error
+	}
+
+	PasswordResetRepository interface {
+		WithContext(ctx context.Context) PasswordResetRepository
+		Create(reset *PasswordResetToken) error
+		FindByHash(hash string) (*PasswordResetToken, error)
+	}
+
+	UserListOptions struct {
+		Offset   int
+		Limit    int
+		SortBy   string
+		SortDesc bool
+		Active   *bool
+
+		// InactiveSince keeps users who have not logged in since then.
+		InactiveSince *time.Time
+		// Fields limits the columns loaded; empty loads them all.
+		Fields []string
+		// CreatedFrom and CreatedTo bound created_at, both inclusive.
+		CreatedFrom *time.Time
+		CreatedTo   *time.Time
+	}
+
+	gormUserRepository struct {
+		db *gorm.DB
+		// fullText is set when users has the search_vector column, so Search
+		// can rank matches instead of falling back to ILIKE.
+		fullText bool
+	}
+
+	gormRefreshTokenRepository struct {
+		db *gorm.DB
+	}
+
+	gormPasswordResetRepository struct {
+		db *gorm.DB
+	}
+
+	gormOutboxRepository struct {
+		db *gorm.DB
+	}
+
+	gormWebhookRepository struct {
+		db *gorm.DB
+	}
+)
+
+func NewUserRepository(db *gorm.DB) UserRepository {
+	return &gormUserRepository{db: db, fullText: db.Migrator().HasColumn(&Users{}, "search_vector")}
+}
+
+// WithContext returns a repository whose queries are bound to ctx, so they are
+// cancelled along with it.
+func (r *gormUserRepository) WithContext(ctx context.Context) UserRepository {
+	return &gormUserRepository{db: r.db.WithContext(ctx), fullText: r.fullText}
+}
+
+// Transaction runs fn against a repository bound to a single database
+// transaction, committing if fn returns nil and rolling back otherwise.
+func (r *gormUserRepository) Transaction(fn func(tx UserRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&gormUserRepository{db: tx, fullText: r.fullText})
+	})
+}
+
+func (r *gormUserRepository) Create(user *Users) error {
+	return r.db.Create(user).Error
+}
+
+// FindByID loads the user with id, limited to fields when any are given.
+func (r *gormUserRepository) FindByID(id string, fields ...string) (*Users, error) {
+	var res Users
+	query := r.db.Model(&Users{})
+	if len(fields) > 0 {
+		query = query.Select(fields)
+	}
+	if err := query.First(&res, "user_id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) FindByIDs(ids []int) ([]Users, error) {
+	res := []Users{}
+	err := r.db.Where("user_id IN ?", ids).Find(&res).Error
+	return res, err
+}
+
+func (r *gormUserRepository) FindAll(opts UserListOptions) ([]Users, int64, error) {
+	return r.list(r.db.Model(&Users{}), opts, nil)
+}
+
+// FindAfter returns up to opts.Limit users matching opts that come after the
+// cursor in created_at, user_id order, starting from the first when after is
+// nil. opts.Offset and opts.SortBy are ignored.
+func (r *gormUserRepository) FindAfter(after *UserCursor, opts UserListOptions) ([]Users, error) {
+	query := filter(r.db.Model(&Users{}), opts)
+	if after != nil {
+		query = query.Where("(created_at, user_id) > (?, ?)", after.CreatedAt, after.ID)
+	}
+	if len(opts.Fields) > 0 {
+		query = query.Select(opts.Fields)
+	}
+	res := []Users{}
+	err := query.Order("created_at, user_id").Limit(opts.Limit).Find(&res).Error
+	return res, err
+}
+
+// Search matches q against username, names and email. With the search_vector
+// column every word of q must prefix-match and results are ranked by
+// relevance unless opts.SortBy is set; without it, q is matched as a single
+// substring.
+func (r *gormUserRepository) Search(q string, opts UserListOptions) ([]Users, int64, error) {
+	if tsq := prefixQuery(q); r.fullText && tsq != "" {
+		query := r.db.Model(&Users{}).Where("search_vector @@ to_tsquery('simple', ?)", tsq)
+		rank := clause.Expr{SQL: "ts_rank(search_vector, to_tsquery('simple', ?))", Vars: []interface{}{tsq}}
+		return r.list(query, opts, &rank)
+	}
+	pattern := "%" + likeEscaper.Replace(q) + "%"
+	query := r.db.Model(&Users{}).Where(
+		"username ILIKE ? OR first_name ILIKE ? OR last_name ILIKE ? OR email ILIKE ?",
+		pattern, pattern, pattern, pattern,
+	)
+	return r.list(query, opts, nil)
+}
+
+var tsqueryOperators = strings.NewReplacer("&", " ", "|", " ", "!", " ", "(", " ", ")", " ", ":", " ", "*", " ", "<", " ", ">", " ", "'", " ", "\\", " ")
+
+// prefixQuery turns free text into a to_tsquery expression requiring each word
+// as a prefix, or "" when no word is left once operators are stripped.
+func prefixQuery(q string) string {
+	words := strings.Fields(tsqueryOperators.Replace(q))
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// Each streams every user to fn in user_id order without loading the whole
+// table into memory, stopping at the first error fn returns.
+func (r *gormUserRepository) Each(fn func(user *Users) error) error {
+	rows, err := r.db.Model(&Users{}).Order("user_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user Users
+		if err := r.db.ScanRows(rows, &user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Count returns how many users match the filters in opts.
+func (r *gormUserRepository) Count(opts UserListOptions) (int64, error) {
+	var total int64
+	err := filter(r.db.Model(&Users{}), opts).Count(&total).Error
+	return total, err
+}
+
+// filter narrows query to the users matching the filters in opts.
+func filter(query *gorm.DB, opts UserListOptions) *gorm.DB {
+	if opts.Active != nil {
+		query = query.Where("is_active = ?", *opts.Active)
+	}
+	if opts.InactiveSince != nil {
+		query = query.Where("last_login_at IS NULL OR last_login_at < ?", *opts.InactiveSince)
+	}
+	switch {
+	case opts.CreatedFrom != nil && opts.CreatedTo != nil:
+		query = query.Where("created_at BETWEEN ? AND ?", *opts.CreatedFrom, *opts.CreatedTo)
+	case opts.CreatedFrom != nil:
+		query = query.Where("created_at >= ?", *opts.CreatedFrom)
+	case opts.CreatedTo != nil:
+		query = query.Where("created_at <= ?", *opts.CreatedTo)
+	}
+	return query
+}
+
+// list counts the rows matched by query, then returns the requested page in
+// the requested order. opts.SortBy must already be a whitelisted column. When
+// opts.SortBy is empty and rank is given, rows come highest rank first.
+func (r *gormUserRepository) list(query *gorm.DB, opts UserListOptions, rank *clause.Expr) ([]Users, int64, error) {
+	query = filter(query, opts)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	sortBy := opts.SortBy
+	if sortBy == "" {
+		sortBy = "user_id"
+	}
+	if len(opts.Fields) > 0 {
+		query = query.Select(opts.Fields)
+	}
+	if opts.SortBy == "" && rank != nil {
+		query = query.Clauses(clause.OrderBy{Expression: clause.Expr{SQL: "? DESC, user_id", Vars: []interface{}{*rank}}})
+	} else {
+		query = query.Order(clause.OrderByColumn{Column: clause.Column{Name: sortBy}, Desc: opts.SortDesc})
+		if sortBy != "user_id" {
+			// Break ties on non-unique columns so pages never overlap or skip rows.
+			query = query.Order("user_id")
+		}
+	}
+	res := []Users{}
+	err := query.
+		Offset(opts.Offset).
+		Limit(opts.Limit).
+		Find(&res).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, total, nil
+}
+
+// Update saves the non-zero fields of user provided its version still matches
+// the stored one, then bumps the version. It returns errVersionConflict when
+// another write got there first.
+func (r *gormUserRepository) Update(user *Users) error {
+	return r.saveVersioned(user, r.db.Model(user))
+}
+
+// Replace writes every user-editable column, including empty values that
+// Update would skip.
+func (r *gormUserRepository) Replace(user *Users) error {
+	return r.saveVersioned(user, r.db.Model(user).
+		Select("username", "password", "first_name", "last_name", "phone", "email", "birthday", "timezone", "version"))
+}
+
+func (r *gormUserRepository) saveVersioned(user *Users, query *gorm.DB) error {
+	expected := user.Version
+	user.Version++
+	res := query.Where("version = ?", expected).Updates(user)
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = errVersionConflict
+	}
+	if res.Error != nil {
+		user.Version = expected
+	}
+	return res.Error
+}
+
+// Delete soft-deletes user along with their credentials, as revokeCredentials
+// describes, returning gorm.ErrRecordNotFound when no row was deleted because
+// the user is already gone.
+func (r *gormUserRepository) Delete(user *Users) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(user)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+		user.VerificationTokenHash = nil
+		return revokeCredentials(tx, []int{user.UserID})
+	})
+}
+
+// DeleteInactiveBefore soft-deletes inactive users created before cutoff,
+// revoking their credentials, and returns the users it deleted.
+func (r *gormUserRepository) DeleteInactiveBefore(cutoff time.Time) ([]Users, error) {
+	var deleted []Users
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("is_active = ? AND created_at < ?", false, cutoff).Find(&deleted).Error
+		if err != nil || len(deleted) == 0 {
+			return err
+		}
+		ids := make([]int, len(deleted))
+		for i := range deleted {
+			ids[i] = deleted[i].UserID
+		}
+		if err := tx.Where("user_id IN ?", ids).Delete(&Users{}).Error; err != nil {
+			return err
+		}
+		return revokeCredentials(tx, ids)
+	})
+	return deleted, err
+}
+
+// revokeCredentials stops deleted users from getting back in: their refresh
+// tokens are revoked, their unused password reset tokens are spent and any
+// pending verification token is cleared.
+func revokeCredentials(tx *gorm.DB, userIDs []int) error {
+	err := tx.Model(&RefreshToken{}).Where("user_id IN ? AND revoked = ?", userIDs, false).
+		Update("revoked", true).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&PasswordResetToken{}).Where("user_id IN ? AND used_at IS NULL", userIDs).
+		Update("used_at", time.Now()).Error
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Model(&Users{}).Where("user_id IN ?", userIDs).
+		UpdateColumn("verification_token_hash", nil).Error
+}
+
+func (r *gormUserRepository) FindByUsername(username string) (*Users, error) {
+	var res Users
+	if err := r.db.Where("username = ?", username).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) FindByEmail(email string) (*Users, error) {
+	var res Users
+	if err := r.db.Where("email = ?", email).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) FindDeletedByID(id string) (*Users, error) {
+	var res Users
+	if err := r.db.Unscoped().Where("deleted_at IS NOT NULL").First(&res, "user_id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) Restore(user *Users) error {
+	return r.db.Unscoped().Model(user).Update("deleted_at", nil).Error
+}
+
+// UpdatePassword stores hash as user's password.
+func (r *gormUserRepository) UpdatePassword(user *Users, hash string) error {
+	user.Password = hash
+	return r.db.Model(user).Select("password").Updates(user).Error
+}
+
+// RecentPasswordHashes returns up to limit of the user's previous password
+// hashes, newest first.
+func (r *gormUserRepository) RecentPasswordHashes(userID, limit int) ([]string, error) {
+	var hashes []string
+	err := r.db.Model(&PasswordHistory{}).Where("user_id = ?", userID).
+		Order("id DESC").Limit(limit).Pluck("password_hash", &hashes).Error
+	return hashes, err
+}
+
+// AddPasswordHistory records entry and drops all but the user's keep newest
+// entries.
+func (r *gormUserRepository) AddPasswordHistory(entry *PasswordHistory, keep int) error {
+	if err := r.db.Create(entry).Error; err != nil {
+		return err
+	}
+	newest := r.db.Model(&PasswordHistory{}).Select("id").
+		Where("user_id = ?", entry.UserID).Order("id DESC").Limit(keep)
+	return r.db.Where("user_id = ? AND id NOT IN (?)", entry.UserID, newest).
+		Delete(&PasswordHistory{}).Error
+}
+
+// ClaimPasswordReset marks reset used, reporting false if another request
+// already used it. It lives here rather than on PasswordResetRepository so the
+// claim commits or rolls back with the new password.
+func (r *gormUserRepository) ClaimPasswordReset(reset *PasswordResetToken) (bool, error) {
+	now := time.Now()
+	res := r.db.Model(reset).Where("used_at IS NULL").Update("used_at", now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	reset.UsedAt = &now
+	return true, nil
+}
+
+// RevokeSessions revokes every refresh token of userID and spends their
+// other unused password reset tokens.
+func (r *gormUserRepository) RevokeSessions(userID int) error {
+	err := r.db.Model(&RefreshToken{}).Where("user_id = ? AND revoked = ?", userID, false).
+		Update("revoked", true).Error
+	if err != nil {
+		return err
+	}
+	return r.db.Model(&PasswordResetToken{}).Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", time.Now()).Error
+}
+
+func (r *gormUserRepository) FindByVerificationHash(hash string) (*Users, error) {
+	var res Users
+	if err := r.db.Where("verification_token_hash = ?", hash).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) Activate(user *Users) error {
+	err := r.db.Model(user).Updates(map[string]interface{}{
+		"is_active":               true,
+		"verification_token_hash": nil,
+	}).Error
+	if err != nil {
+		return err
+	}
+	user.IsActive = true
+	user.VerificationTokenHash = nil
+	return nil
+}
+
+// SaveLoginAttempts stores the lockout counters without bumping updated_at, so
+// failed logins do not change the user's ETag.
+func (r *gormUserRepository) SaveLoginAttempts(user *Users) error {
+	return r.db.Model(user).UpdateColumns(map[string]interface{}{
+		"failed_login_count": user.FailedLoginCount,
+		"locked_until":       user.LockedUntil,
+	}).Error
+}
+
+func (r *gormUserRepository) SetAvatar(user *Users, url *string) error {
+	if err := r.db.Model(user).Update("avatar_url", url).Error; err != nil {
+		return err
+	}
+	user.AvatarURL = url
+	return nil
+}
+
+func (r *gormUserRepository) FindIdempotencyKey(callerID, key string) (*IdempotencyKey, error) {
+	var res IdempotencyKey
+	if err := r.db.Where("caller_id = ? AND key = ?", callerID, key).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormUserRepository) CreateIdempotencyKey(record *IdempotencyKey) error {
+	return r.db.Create(record).Error
+}
+
+func (r *gormUserRepository) DeleteIdempotencyKey(record *IdempotencyKey) error {
+	return r.db.Delete(record).Error
+}
+
+func (r *gormUserRepository) SavePhoneVerification(user *Users) error {
+	return r.db.Model(user).
+		Select("phone_verified", "phone_otp_hash", "phone_otp_expires_at", "phone_otp_attempts").
+		Updates(user).Error
+}
+
+// ClaimPhoneOTPAttempt counts one guess at the user's phone code, reporting
+// false once max guesses have been made. The check and the increment are one
+// statement, so concurrent guesses cannot exceed max.
+func (r *gormUserRepository) ClaimPhoneOTPAttempt(user *Users, max int) (bool, error) {
+	result := r.db.Model(&Users{}).
+		Where("user_id = ? AND phone_otp_attempts < ?", user.UserID, max).
+		UpdateColumn("phone_otp_attempts", gorm.Expr("phone_otp_attempts + 1"))
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.PhoneOTPAttempts++
+	return true, nil
+}
+
+func (r *gormUserRepository) SetActive(user *Users, active bool) error {
+	return r.db.Model(user).Update("is_active", active).Error
+}
+
+// UpdateColumns writes the named columns of user, zero values included.
+func (r *gormUserRepository) UpdateColumns(user *Users, columns ...string) error {
+	return r.db.Model(user).Select(columns).Updates(user).Error
+}
+
+func (r *gormUserRepository) SaveMFA(user *Users) error {
+	return r.db.Model(user).Select("mfa_enabled", "mfa_secret").Updates(user).Error
+}
+
+// UseMFAStep records step as the user's last accepted TOTP time step. It
+// reports false when that step or a later one has already been used, which a
+// concurrent request may have done since user was read.
+func (r *gormUserRepository) UseMFAStep(user *Users, step int64) (bool, error) {
+	result := r.db.Model(&Users{}).
+		Where("user_id = ? AND (mfa_last_step IS NULL OR mfa_last_step < ?)", user.UserID, step).
+		UpdateColumn("mfa_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	user.MFALastStep = &step
+	return true, nil
+}
+
+// RecordLogin stamps last_login_at without bumping updated_at, which tracks
+// changes to the profile rather than activity.
+func (r *gormUserRepository) RecordLogin(user *Users) error {
+	now := time.Now()
+	if err := r.db.Model(user).UpdateColumn("last_login_at", now).Error; err != nil {
+		return err
+	}
+	user.LastLoginAt = &now
+	return nil
+}
+
+func (r *gormUserRepository) CreateAudit(entry *UserAudit) error {
+	return r.db.Create(entry).Error
+}
+
+// FindAudits returns the audit trail of userID, newest first.
+func (r *gormUserRepository) FindAudits(userID int) ([]UserAudit, error) {
+	res := []UserAudit{}
+	err := r.db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Find(&res).Error
+	return res, err
+}
+
+func (r *gormUserRepository) CreateOutboxEvent(event *OutboxEvent) error {
+	return r.db.Create(event).Error
+}
+
+// IsTaken reports whether a user other than exceptID already holds value in
+// column. column must be a trusted column name, never user input.
+func (r *gormUserRepository) IsTaken(column, value string, exceptID int) (bool, error) {
+	var count int64
+	err := r.db.Model(&Users{}).Where(column+" = ? AND user_id <> ?", value, exceptID).Count(&count).Error
+	return count > 0, err
+}
+
+// Exists reports whether any user, deleted ones included since they still
+// hold their unique values, has value in column. column must be a trusted
+// column name, never user input.
+func (r *gormUserRepository) Exists(column, value string) (bool, error) {
+	var found []int
+	err := r.db.Unscoped().Model(&Users{}).Select("1").Where(column+" = ?", value).Limit(1).Find(&found).Error
+	return len(found) > 0, err
+}
+
+func NewRefreshTokenRepository(db *gorm.DB) RefreshTokenRepository {
+	return &gormRefreshTokenRepository{db: db}
+}
+
+func (r *gormRefreshTokenRepository) WithContext(ctx context.Context) RefreshTokenRepository {
+	return &gormRefreshTokenRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *gormRefreshTokenRepository) Create(token *RefreshToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r *gormRefreshTokenRepository) FindByHash(hash string) (*RefreshToken, error) {
+	var res RefreshToken
+	if err := r.db.Where("token_hash = ?", hash).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// FindActiveByUser returns the user's unrevoked, unexpired tokens, newest
+// first.
+func (r *gormRefreshTokenRepository) FindActiveByUser(userID int) ([]RefreshToken, error) {
+	res := []RefreshToken{}
+	err := r.db.Where("user_id = ? AND revoked = ? AND expires_at > ?", userID, false, time.Now()).
+		Order("created_at DESC, id DESC").Find(&res).Error
+	return res, err
+}
+
+func (r *gormRefreshTokenRepository) FindByIDForUser(id, userID int) (*RefreshToken, error) {
+	var res RefreshToken
+	if err := r.db.Where("id = ? AND user_id = ?", id, userID).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormRefreshTokenRepository) Revoke(token *RefreshToken) error {
+	return r.db.Model(token).Update("revoked", true).Error
+}
+
+func NewPasswordResetRepository(db *gorm.DB) PasswordResetRepository {
+	return &gormPasswordResetRepository{db: db}
+}
+
+func (r *gormPasswordResetRepository) WithContext(ctx context.Context) PasswordResetRepository {
+	return &gormPasswordResetRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *gormPasswordResetRepository) Create(reset *PasswordResetToken) error {
+	return r.db.Create(reset).Error
+}
+
+func (r *gormPasswordResetRepository) FindByHash(hash string) (*PasswordResetToken, error) {
+	var res PasswordResetToken
+	if err := r.db.Where("token_hash = ?", hash).First(&res).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func NewOutboxRepository(db *gorm.DB) OutboxRepository {
+	return &gormOutboxRepository{db: db}
+}
+
+func (r *gormOutboxRepository) WithContext(ctx context.Context) OutboxRepository {
+	return &gormOutboxRepository{db: r.db.WithContext(ctx)}
+}
+
+// Relay passes up to limit unpublished events to fn, oldest first, marking
+// each published once fn succeeds and stopping at the first failure. The
+// rows stay locked until it returns, and rows locked by another instance are
+// skipped, so concurrent relays never hand out the same event.
+func (r *gormOutboxRepository) Relay(limit int, fn func(event OutboxEvent) error) (int, error) {
+	published := 0
+	var errFn error
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var events []OutboxEvent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL").Order("id").Limit(limit).Find(&events).Error
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			// Commit what was published so far rather than rolling it back.
+			if errFn = fn(events[i]); errFn != nil {
+				return nil
+			}
+			if err := tx.Model(&events[i]).Update("published_at", time.Now()).Error; err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	if err == nil {
+		err = errFn
+	}
+	return published, err
+}
+
+func NewWebhookRepository(db *gorm.DB) WebhookRepository {
+	return &gormWebhookRepository{db: db}
+}
+
+func (r *gormWebhookRepository) WithContext(ctx context.Context) WebhookRepository {
+	return &gormWebhookRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *gormWebhookRepository) Create(hook *Webhook) error {
+	return r.db.Create(hook).Error
+}
+
+func (r *gormWebhookRepository) FindAll() ([]Webhook, error) {
+	res := []Webhook{}
+	err := r.db.Order("id").Find(&res).Error
+	return res, err
+}
+
+func (r *gormWebhookRepository) FindByID(id string) (*Webhook, error) {
+	var res Webhook
+	if err := r.db.First(&res, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *gormWebhookRepository) Replace(hook *Webhook) error {
+	return r.db.Model(hook).Select("url", "secret", "events", "active").Updates(hook).Error
+}
+
+// Delete removes hook; its deliveries go with it through the foreign key.
+func (r *gormWebhookRepository) Delete(hook *Webhook) error {
+	return r.db.Delete(hook).Error
+}
+
+// FindDeliveries returns up to limit of the webhook's deliveries, newest first.
+func (r *gormWebhookRepository) FindDeliveries(webhookID, limit int) ([]WebhookDelivery, error) {
+	res := []WebhookDelivery{}
+	err := r.db.Where("webhook_id = ?", webhookID).Order("id DESC").Limit(limit).Find(&res).Error
+	return res, err
+}
+
+// Enqueue queues a delivery of event to every active webhook subscribed to
+// its type, due immediately.
+func (r *gormWebhookRepository) Enqueue(event Event) error {
+	var hooks []Webhook
+	err := r.db.Where("active AND events @> ?", EventTypes{event.Type}).Find(&hooks).Error
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	deliveries := make([]WebhookDelivery, 0, len(hooks))
+	for _, hook := range hooks {
+		deliveries = append(deliveries, WebhookDelivery{
+			WebhookID:     hook.ID,
+			EventType:     event.Type,
+			UserID:        event.UserID,
+			OccurredAt:    event.OccurredAt,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	return r.db.Omit("Webhook").Create(&deliveries).Error
+}
+
+// ClaimDue returns up to limit pending deliveries whose next attempt is due,
+// oldest first and with their webhook loaded. Claimed deliveries are pushed
+// back by lease, so neither this instance nor another sends them again unless
+// the attempt is never saved.
+func (r *gormWebhookRepository) ClaimDue(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	res := []WebhookDelivery{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var ids []int
+		err := tx.Model(&WebhookDelivery{}).Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at, id").Limit(limit).Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		err = tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).
+			UpdateColumn("next_attempt_at", time.Now().Add(lease)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Preload("Webhook").Where("id IN ?", ids).Order("id").Find(&res).Error
+	})
+	return res, err
+}
+
+// SaveDelivery records the outcome of an attempt at delivery.
+func (r *gormWebhookRepository) SaveDelivery(delivery *WebhookDelivery) error {
+	return r.db.Model(delivery).Updates(map[string]interface{}{
+		"attempts":        delivery.Attempts,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"last_error":      delivery.LastError,
+		"delivered_at":    delivery.DeliveredAt,
+		"failed_at":       delivery.FailedAt,
+	}).Error
+}
+
+// uniqueViolationField reports the column behind a Postgres unique-violation
+// error, parsed from a detail message like "Key (email)=(x) already exists.".
+func uniqueViolationField(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+		return "", false
+	}
+	field := pgErr.ConstraintName
+	if start := strings.Index(pgErr.Detail, "Key ("); start >= 0 {
+		rest := pgErr.Detail[start+len("Key ("):]
+		if end := strings.Index(rest, ")="); end >= 0 {
+			field = rest[:end]
+		}
+	}
+	return field, true
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestPrefixQuery(t *testing.T) {
+	for q, want := range map[string]string{
+		"":                 "",
+		"ada":              "ada:*",
+		"  ada   love ":    "ada:* & love:*",
+		"ada & !(love)|'x": "ada:* & love:* & x:*",
+		"a:*b<c>\\":        "a:* & b:* & c:*",
+		"&|!()":            "",
+	} {
+		if got := prefixQuery(q); got != want {
+			t.Errorf("prefixQuery(%q) = %q, want %q", q, got, want)
+		}
+	}
+}
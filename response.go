@@ -0,0 +1,22 @@
+package main
+
+import "github.com/labstack/echo/v4"
+
+type (
+	// SuccessResponse is the envelope around every successful JSON response.
+	SuccessResponse struct {
+		Data interface{} `json:"data"`
+		Meta interface{} `json:"meta,omitempty"`
+	}
+
+	PageMeta struct {
+		Page  int   `json:"page"`
+		Limit int   `json:"limit"`
+		Total int64 `json:"total"`
+	}
+)
+
+// respondOK writes data, and meta when it is not nil, in a SuccessResponse.
+func respondOK(c echo.Context, code int, data, meta interface{}) error {
+	return c.JSON(code, SuccessResponse{Data: data, Meta: meta})
+}
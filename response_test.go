@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRespondOK(t *testing.T) {
+	for _, tc := range []struct {
+		data, meta interface{}
+		want       string
+	}{
+		{echo.Map{"id": 1}, nil, `{"data":{"id":1}}`},
+		{[]int{}, PageMeta{Page: 2, Limit: 10, Total: 11}, `{"data":[],"meta":{"page":2,"limit":10,"total":11}}`},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		if err := respondOK(c, http.StatusOK, tc.data, tc.meta); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Body.String(); got != tc.want+"\n" {
+			t.Errorf("body = %s, want %s", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/brianvoe/gofakeit/v6"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// runSeed implements the "seed" subcommand, which fills a development
+// database with fake users. It does nothing when users already exist unless
+// -force is given.
+func runSeed(db *gorm.DB, cost int, args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	count := fs.Int("n", defaultSeedUsers, "number of users to create")
+	password := fs.String("password", defaultSeedPassword, "password given to every seeded user")
+	force := fs.Bool("force", false, "seed even if users already exist")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 {
+		return fmt.Errorf("-n must be positive, got %d", *count)
+	}
+
+	var existing int64
+	if err := db.Model(&Users{}).Count(&existing).Error; err != nil {
+		return err
+	}
+	if existing > 0 && !*force {
+		zap.L().Info("users already exist, skipping seed", zap.Int64("count", existing))
+		return nil
+	}
+
+	// Hashing is slow on purpose, so do it once for every user.
+	hash, err := hashPassword(*password, cost)
+	if err != nil {
+		return err
+	}
+	users := make([]Users, *count)
+	for i := range users {
+		users[i] = fakeUser(hash)
+	}
+	if err := db.CreateInBatches(users, seedBatchSize).Error; err != nil {
+		return err
+	}
+	zap.L().Info("seeded users", zap.Int("count", *count))
+	return nil
+}
+
+// fakeUser returns a user with random details. A random suffix keeps the
+// unique columns from colliding with each other or with earlier seeds.
+func fakeUser(passwordHash string) Users {
+	suffix := strings.ToLower(gofakeit.LetterN(6))
+	first, last := gofakeit.FirstName(), gofakeit.LastName()
+	phone := "+" + defaultPhoneCountryCode + "8" + gofakeit.Numerify("##########")
+	birthday := gofakeit.DateRange(time.Now().AddDate(-80, 0, 0), time.Now().AddDate(-defaultMinAge, 0, 0))
+	return Users{
+		Username:  strings.ToLower(first) + "." + suffix,
+		Password:  passwordHash,
+		FirstName: first,
+		LastName:  last,
+		Phone:     &phone,
+		Email:     strings.ToLower(first+"."+last) + "." + suffix + "@example.com",
+		Birthday:  &birthday,
+		IsActive:  gofakeit.Bool(),
+		Role:      roleUser,
+	}
+}
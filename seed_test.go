@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+// Seeded users must look like ones the API would have accepted.
+func TestFakeUserIsValid(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for i := 0; i < 20; i++ {
+		user := fakeUser("hash")
+		request := UserRequest{
+			Username:  user.Username,
+			Password:  "Str0ng-passw0rd",
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Phone:     *user.Phone,
+			Email:     user.Email,
+			Birthday:  user.Birthday.Format("2006-01-02"),
+		}
+		if err := cv.Validate(&request); err != nil {
+			t.Fatalf("fake user %+v is invalid: %v", request, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+)
+
+// ListSessions lists the caller's logged-in devices: every refresh token of
+// theirs that is neither revoked nor expired.
+// @Summary List my active sessions
+// @Tags me
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} SuccessResponse{data=[]RefreshToken}
+// @Failure 401 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me/sessions [get]
+func (h *UserHandler) ListSessions(c echo.Context) error {
+	userID, _ := c.Get("user_id").(int)
+	sessions, err := h.refreshTokens(c).FindActiveByUser(userID)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, sessions, nil)
+}
+
+// @Summary Revoke one of my sessions
+// @Tags me
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Session ID"
+// @Success 200 {object} SuccessResponse{data=map[string]string}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /me/sessions/{id} [delete]
+func (h *UserHandler) RevokeSession(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid session id")
+	}
+	userID, _ := c.Get("user_id").(int)
+	// Scoping the lookup to the caller reports other users' sessions as
+	// missing rather than forbidden.
+	session, err := h.refreshTokens(c).FindByIDForUser(id, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "session not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if !session.Revoked {
+		if err := h.refreshTokens(c).Revoke(session); err != nil {
+			return respondError(c, http.StatusInternalServerError, err.Error())
+		}
+	}
+	return respondOK(c, http.StatusOK, echo.Map{"message": "session revoked"}, nil)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"time"
+)
+
+// requestTimeout bounds every request's context by d. Handlers pass that
+// context to the database, so slow queries are cancelled once it expires.
+func requestTimeout(d time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx, cancel := context.WithTimeout(c.Request().Context(), d)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	handler := requestTimeout(10 * time.Millisecond)(func(c echo.Context) error {
+		ctx := c.Request().Context()
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("request context has no deadline")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	if err := handler(c); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("handler returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/uptrace/opentelemetry-go-extra/otelgorm"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"gorm.io/gorm"
+)
+
+// setupTracing exports spans over OTLP/HTTP when cfg names an endpoint. The
+// exporter takes the rest of its settings, such as OTEL_EXPORTER_OTLP_HEADERS,
+// from the standard OTEL_* variables. Without an endpoint the global tracer
+// provider stays the no-op default, so the instrumentation costs next to
+// nothing. The returned function flushes pending spans on shutdown.
+func setupTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceNameKey.String(tracingServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a server span for every request except metrics scrapes,
+// continuing the caller's trace when it sends a traceparent header.
+func traceRequests(metricsPath string) echo.MiddlewareFunc {
+	return otelecho.Middleware(tracingServiceName, otelecho.WithSkipper(func(c echo.Context) bool {
+		return c.Path() == metricsPath
+	}))
+}
+
+// traceQueries records a span for each query run with a request's context,
+// nested under that request's span. Query arguments are left out, since they
+// include password hashes and tokens.
+func traceQueries(db *gorm.DB) error {
+	return db.Use(otelgorm.NewPlugin(otelgorm.WithoutQueryVariables(), otelgorm.WithoutMetrics()))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetupTracingWithoutEndpoint(t *testing.T) {
+	before := otel.GetTracerProvider()
+	shutdown, err := setupTracing(context.Background(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otel.GetTracerProvider() != before {
+		t.Error("setupTracing() without an endpoint replaced the tracer provider")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() = %v", err)
+	}
+}
+
+func TestTraceRequestsSkipsMetrics(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	before := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(before) })
+
+	e := echo.New()
+	e.Use(traceRequests(defaultMetricsPath))
+	for _, path := range []string{defaultMetricsPath, "/users/:id"} {
+		e.GET(path, func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+	}
+	for _, path := range []string{defaultMetricsPath, "/users/7"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "/users/:id" {
+		names := make([]string, len(spans))
+		for i, span := range spans {
+			names[i] = span.Name()
+		}
+		t.Errorf("spans = %q, want only /users/:id", names)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	// Embedded so the timezone rule does not depend on the host's tz database.
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+)
+
+// newValidator builds the request validator, with the custom rules reading
+// their limits from cfg.
+func newValidator(cfg *Config) (*CustomValidator, error) {
+	cv := &CustomValidator{validator: validator.New(), cfg: cfg}
+	cv.validator.RegisterTagNameFunc(jsonFieldName)
+	cv.validator.RegisterValidation("strongpassword", cv.validateStrongPassword)
+	cv.validator.RegisterValidation("minage", cv.validateMinAge)
+	cv.validator.RegisterValidation("emaildomain", cv.validateEmailDomain)
+	translators, err := cv.newTranslators()
+	if err != nil {
+		return nil, err
+	}
+	cv.translators = translators
+	return cv, nil
+}
+
+// passwordRuleFailures lists every strength rule the password does not satisfy.
+func (cv *CustomValidator) passwordRuleFailures(password string) []string {
+	var upper, lower, digit, special bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			special = true
+		}
+	}
+	var failures []string
+	if minLen := cv.cfg.PasswordMinLength; utf8.RuneCountInString(password) < minLen {
+		failures = append(failures, "be at least "+strconv.Itoa(minLen)+" characters long")
+	}
+	if !upper {
+		failures = append(failures, "contain an uppercase letter")
+	}
+	if !lower {
+		failures = append(failures, "contain a lowercase letter")
+	}
+	if !digit {
+		failures = append(failures, "contain a digit")
+	}
+	if !special {
+		failures = append(failures, "contain a special character")
+	}
+	return failures
+}
+
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// normalizeEmail trims and lowercases an email so addresses differing only in
+// case are stored, and collide, as one.
+func normalizeEmail(raw string) string {
+	return strings.ToLower(strings.TrimSpace(raw))
+}
+
+// normalizeUsername trims surrounding whitespace; case is kept as given.
+func normalizeUsername(raw string) string {
+	return strings.TrimSpace(raw)
+}
+
+// normalizePhone rewrites a phone number into E.164 form. National numbers with
+// a leading 0 get countryCode; anything it cannot make sense of is returned
+// as-is so the e164 validator rejects it.
+func normalizePhone(raw, countryCode string) string {
+	phone := phoneSeparators.Replace(strings.TrimSpace(raw))
+	switch {
+	case strings.HasPrefix(phone, "00"):
+		return "+" + phone[2:]
+	case strings.HasPrefix(phone, "0"):
+		return "+" + countryCode + phone[1:]
+	}
+	return phone
+}
+
+func (cv *CustomValidator) validateStrongPassword(fl validator.FieldLevel) bool {
+	return len(cv.passwordRuleFailures(fl.Field().String())) == 0
+}
+
+// minAge returns the minimum age from the tag parameter, or from MIN_AGE when
+// the tag has none.
+func (cv *CustomValidator) minAge(param string) int {
+	if n, err := strconv.Atoi(param); err == nil {
+		return n
+	}
+	return cv.cfg.MinAge
+}
+
+// ageOn returns the number of whole years between birthday and now. A
+// birthday that has not yet come round this year, including 29 February in a
+// non-leap year before 1 March, does not count.
+func ageOn(birthday, now time.Time) int {
+	years := now.Year() - birthday.Year()
+	if now.Month() < birthday.Month() || (now.Month() == birthday.Month() && now.Day() < birthday.Day()) {
+		years--
+	}
+	return years
+}
+
+// validateMinAge checks a YYYY-MM-DD birthday against minAge. Unparseable
+// values pass so the datetime rule reports them instead.
+func (cv *CustomValidator) validateMinAge(fl validator.FieldLevel) bool {
+	birthday, err := time.Parse("2006-01-02", fl.Field().String())
+	if err != nil {
+		return true
+	}
+	return ageOn(birthday, time.Now()) >= cv.minAge(fl.Param())
+}
+
+// domainMatches reports whether domain is pattern or, for a pattern like
+// "*.example.com", any subdomain of example.com.
+func domainMatches(domain, pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix := strings.TrimPrefix(pattern, "*"); suffix != pattern {
+		return strings.HasSuffix(domain, suffix)
+	}
+	return domain == pattern
+}
+
+func domainListed(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if domainMatches(domain, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEmailDomain rejects emails whose domain is on EMAIL_DOMAIN_BLOCKLIST
+// or, when EMAIL_DOMAIN_ALLOWLIST is set, missing from it.
+func (cv *CustomValidator) validateEmailDomain(fl validator.FieldLevel) bool {
+	email := fl.Field().String()
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	if domainListed(domain, cv.cfg.EmailDomainBlocklist) {
+		return false
+	}
+	allowed := cv.cfg.EmailDomainAllowlist
+	return len(allowed) == 0 || domainListed(domain, allowed)
+}
+
+// ValidationError lists every field of a request that failed validation.
+type ValidationError struct {
+	Errors []FieldError
+
+	fields      validator.ValidationErrors
+	translators *ut.UniversalTranslator
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		messages[i] = fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// jsonFieldName names struct fields by their JSON tag in validation errors.
+func jsonFieldName(field reflect.StructField) string {
+	name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+// fieldErrorMessage describes a single failed rule for the client.
+func (cv *CustomValidator) fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fe.Field() + " is required"
+	case "email":
+		return fe.Field() + " must be a valid email address"
+	case "e164":
+		return fe.Field() + " must be a phone number in E.164 format"
+	case "datetime":
+		return fe.Field() + " must be a date in YYYY-MM-DD format"
+	case "min":
+		if fe.Kind() == reflect.Slice {
+			return fe.Field() + " must list at least " + fe.Param() + " items"
+		}
+		return fe.Field() + " must be at least " + fe.Param() + " characters"
+	case "url":
+		return fe.Field() + " must be an absolute URL"
+	case "strongpassword":
+		return fe.Field() + " must " + strings.Join(cv.passwordRuleFailures(fe.Value().(string)), ", ")
+	case "emaildomain":
+		return fe.Field() + " domain is not allowed"
+	case "oneof":
+		return fe.Field() + " must be one of: " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "timezone":
+		return fe.Field() + " must be an IANA time zone such as America/New_York"
+	case "minage":
+		return "user must be at least " + strconv.Itoa(cv.minAge(fe.Param())) + " years old"
+	default:
+		return fe.Field() + " failed the " + fe.Tag() + " rule"
+	}
+}
+
+func (cv *CustomValidator) Validate(i interface{}) error {
+	if err := cv.validator.Struct(i); err != nil {
+		var verrs validator.ValidationErrors
+		if !errors.As(err, &verrs) {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+		res := &ValidationError{
+			Errors:      make([]FieldError, 0, len(verrs)),
+			fields:      verrs,
+			translators: cv.translators,
+		}
+		for _, fe := range verrs {
+			res.Errors = append(res.Errors, FieldError{
+				Field:   fe.Field(),
+				Rule:    fe.Tag(),
+				Message: cv.fieldErrorMessage(fe),
+			})
+		}
+		return res
+	}
+	return nil
+}
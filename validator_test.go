@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testValidator(t *testing.T, cfg *Config) *CustomValidator {
+	t.Helper()
+	if cfg.PasswordMinLength == 0 {
+		cfg.PasswordMinLength = defaultPasswordMinLength
+	}
+	if cfg.MinAge == 0 {
+		cfg.MinAge = defaultMinAge
+	}
+	cv, err := newValidator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cv
+}
+
+func TestPasswordRuleFailures(t *testing.T) {
+	cv := testValidator(t, &Config{PasswordMinLength: 8})
+	for _, tc := range []struct {
+		password string
+		want     []string
+	}{
+		{"Str0ng-passw0rd", nil},
+		{"Sh0rt-p", []string{"be at least 8 characters long"}},
+		{"weak", []string{
+			"be at least 8 characters long",
+			"contain an uppercase letter",
+			"contain a digit",
+			"contain a special character",
+		}},
+		{"ALLCAPS123!", []string{"contain a lowercase letter"}},
+	} {
+		got := cv.passwordRuleFailures(tc.password)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("passwordRuleFailures(%q) = %q, want %q", tc.password, got, tc.want)
+		}
+	}
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	err := cv.Validate(&UserRequest{Password: "Str0ng-passw0rd", Email: "nope"})
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Validate() = %v, want a *ValidationError", err)
+	}
+	rules := map[string]string{}
+	for _, fe := range verr.Errors {
+		if fe.Message == "" {
+			t.Errorf("%s has no message", fe.Field)
+		}
+		rules[fe.Field] = fe.Rule
+	}
+	if len(rules) != 2 || rules["username"] != "required" || rules["email"] != "email" {
+		t.Errorf("errors = %+v, want username required and email email", verr.Errors)
+	}
+}
+
+func TestDomainMatches(t *testing.T) {
+	for _, tc := range []struct {
+		domain, pattern string
+		want            bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "Example.COM", true},
+		{"mail.example.com", "example.com", false},
+		{"mail.example.com", "*.example.com", true},
+		{"a.b.example.com", "*.example.com", true},
+		{"example.com", "*.example.com", false},
+		{"badexample.com", "*.example.com", false},
+	} {
+		if got := domainMatches(tc.domain, tc.pattern); got != tc.want {
+			t.Errorf("domainMatches(%q, %q) = %v, want %v", tc.domain, tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestEmailDomainValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		allow, block []string
+		email        string
+		valid        bool
+	}{
+		{"no lists", nil, nil, "alice@anywhere.org", true},
+		{"allowed", []string{"*.corp.example"}, nil, "alice@mail.corp.example", true},
+		{"not allowed", []string{"*.corp.example"}, nil, "alice@gmail.com", false},
+		{"blocked", nil, []string{"mailinator.com"}, "alice@Mailinator.com", false},
+		{"blocked beats allowed", []string{"example.com"}, []string{"example.com"}, "alice@example.com", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cv := testValidator(t, &Config{EmailDomainAllowlist: tc.allow, EmailDomainBlocklist: tc.block})
+			create := UserRequest{Username: "alice", Password: "Str0ng-passw0rd", Email: tc.email}
+			if err := cv.Validate(&create); (err == nil) != tc.valid {
+				t.Errorf("create: Validate() = %v, want valid %v", err, tc.valid)
+			}
+			if err := cv.Validate(&UserEditRequest{Email: &tc.email}); (err == nil) != tc.valid {
+				t.Errorf("edit: Validate() = %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestTimezoneValidation(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for tz, valid := range map[string]bool{
+		"":                 true,
+		"UTC":              true,
+		"America/New_York": true,
+		"Asia/Kolkata":     true,
+		"Local":            false,
+		"Mars/Olympus":     false,
+		"+02:00":           false,
+	} {
+		create := UserRequest{Username: "alice", Password: "Str0ng-passw0rd", Email: "alice@example.com", Timezone: tz}
+		err := cv.Validate(&create)
+		if (err == nil) != valid {
+			t.Errorf("timezone %q: Validate() = %v, want valid %v", tz, err, valid)
+		}
+		if err != nil && !strings.Contains(err.Error(), "timezone must be an IANA time zone") {
+			t.Errorf("timezone %q: error %q does not explain the rule", tz, err)
+		}
+	}
+	if got := timezoneOrDefault(""); got != defaultTimezone {
+		t.Errorf("timezoneOrDefault(\"\") = %q, want %q", got, defaultTimezone)
+	}
+}
+
+func TestNormalizeEmailAndUsername(t *testing.T) {
+	if got := normalizeEmail("  Foo@Example.COM \t"); got != "foo@example.com" {
+		t.Errorf("normalizeEmail() = %q, want foo@example.com", got)
+	}
+	if got := normalizeUsername(" Alice "); got != "Alice" {
+		t.Errorf("normalizeUsername() = %q, want Alice", got)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for _, tc := range []struct {
+		raw, want string
+		valid     bool
+	}{
+		{"+14155550123", "+14155550123", true},
+		{"0151 2345-6789", "+4915123456789", true},
+		{"0049 (151) 23456789", "+4915123456789", true},
+		{"call me maybe", "callmemaybe", false},
+	} {
+		got := normalizePhone(tc.raw, "49")
+		if got != tc.want {
+			t.Errorf("normalizePhone(%q) = %q, want %q", tc.raw, got, tc.want)
+		}
+		request := UserRequest{Username: "alice", Password: "Str0ng-passw0rd", Email: "alice@example.com", Phone: got}
+		if err := cv.Validate(&request); (err == nil) != tc.valid {
+			t.Errorf("validating phone %q: %v", got, err)
+		}
+	}
+}
+
+func TestBirthdayValidation(t *testing.T) {
+	cv := testValidator(t, &Config{})
+	for birthday, valid := range map[string]bool{
+		"":           true,
+		"1990-05-01": true,
+		"1990-13-45": false,
+		"05/01/1990": false,
+	} {
+		request := UserRequest{Username: "alice", Password: "Str0ng-passw0rd", Email: "alice@example.com", Birthday: birthday}
+		if err := cv.Validate(&request); (err == nil) != valid {
+			t.Errorf("birthday %q: Validate() = %v, want valid %v", birthday, err, valid)
+		}
+	}
+}
+
+func TestAgeOn(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	now := date("2026-10-14")
+	for _, tc := range []struct {
+		birthday string
+		want     int
+	}{
+		{"2013-10-14", 13}, // exactly at a 13-year threshold
+		{"2013-10-15", 12}, // a day short
+		{"2013-10-13", 13}, // a day over
+		{"1990-01-01", 36},
+		{"2008-02-29", 18},
+	} {
+		if got := ageOn(date(tc.birthday), now); got != tc.want {
+			t.Errorf("ageOn(%s) = %d, want %d", tc.birthday, got, tc.want)
+		}
+	}
+	// A leap-day birthday comes round on 1 March in other years.
+	if got := ageOn(date("2008-02-29"), date("2027-02-28")); got != 18 {
+		t.Errorf("ageOn(2008-02-29) on 2027-02-28 = %d, want 18", got)
+	}
+}
+
+func TestMinAgeValidation(t *testing.T) {
+	cv := testValidator(t, &Config{MinAge: 13})
+	today := time.Now()
+	for _, tc := range []struct {
+		birthday time.Time
+		valid    bool
+	}{
+		{today.AddDate(-13, 0, 0), true},
+		{today.AddDate(-13, 0, 1), false},
+		{today.AddDate(-30, 0, 0), true},
+	} {
+		request := UserRequest{Username: "alice", Password: "Str0ng-passw0rd", Email: "alice@example.com", Birthday: tc.birthday.Format("2006-01-02")}
+		if err := cv.Validate(&request); (err == nil) != tc.valid {
+			t.Errorf("birthday %s: Validate() = %v, want valid %v", request.Birthday, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// EventTypes lists the events a webhook subscribes to and is stored as jsonb.
+type EventTypes []EventType
+
+func (t EventTypes) Value() (driver.Value, error) {
+	b, err := json.Marshal(t)
+	return string(b), err
+}
+
+func (t *EventTypes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, t)
+	case string:
+		return json.Unmarshal([]byte(v), t)
+	case nil:
+		*t = nil
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into EventTypes", src)
+}
+
+// WebhookPublisher queues a delivery of each event for every active webhook
+// subscribed to its type. deliverWebhooks sends them.
+type WebhookPublisher struct {
+	webhooks WebhookRepository
+}
+
+func NewWebhookPublisher(webhooks WebhookRepository) *WebhookPublisher {
+	return &WebhookPublisher{webhooks: webhooks}
+}
+
+func (p *WebhookPublisher) Publish(event Event) error {
+	return p.webhooks.Enqueue(event)
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed by secret, sent as
+// "X-Webhook-Signature: sha256=<hex>" so receivers can authenticate it.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhooks sends due webhook deliveries, polling every interval until
+// ctx is cancelled. A failed delivery is retried with exponential backoff and
+// dead-lettered, by setting failed_at, after webhookMaxAttempts tries.
+func deliverWebhooks(ctx context.Context, webhooks WebhookRepository, interval time.Duration) {
+	client := &http.Client{Timeout: webhookTimeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for {
+			due, err := webhooks.WithContext(ctx).ClaimDue(webhookBatchSize, webhookLease)
+			if err != nil {
+				if ctx.Err() == nil {
+					zap.L().Error("claiming webhook deliveries", zap.Error(err))
+				}
+				break
+			}
+			for i := range due {
+				deliverWebhook(ctx, webhooks, client, &due[i])
+			}
+			if len(due) < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func deliverWebhook(ctx context.Context, webhooks WebhookRepository, client *http.Client, delivery *WebhookDelivery) {
+	errPost := postWebhook(ctx, client, delivery)
+	if errPost != nil && ctx.Err() != nil {
+		// Shutting down; the lease runs out and the delivery is retried.
+		return
+	}
+	now := time.Now()
+	delivery.Attempts++
+	switch {
+	case errPost == nil:
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.FailedAt = &now
+		delivery.LastError = errPost.Error()
+		zap.L().Warn("webhook delivery dead-lettered",
+			zap.Int("delivery_id", delivery.ID),
+			zap.Int("webhook_id", delivery.WebhookID),
+			zap.Error(errPost),
+		)
+	default:
+		delivery.NextAttemptAt = now.Add(webhookRetryBackoff << (delivery.Attempts - 1))
+		delivery.LastError = errPost.Error()
+	}
+	if err := webhooks.WithContext(ctx).SaveDelivery(delivery); err != nil {
+		zap.L().Error("saving webhook delivery", zap.Int("delivery_id", delivery.ID), zap.Error(err))
+	}
+}
+
+// postWebhook sends delivery's event, failing unless the receiver answers 2xx.
+func postWebhook(ctx context.Context, client *http.Client, delivery *WebhookDelivery) error {
+	body, err := json.Marshal(Event{Type: delivery.EventType, UserID: delivery.UserID, OccurredAt: delivery.OccurredAt})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("X-Webhook-Event", string(delivery.EventType))
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(delivery.Webhook.Secret, body))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// Drain a little so the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("receiver answered " + res.Status)
+	}
+	return nil
+}
+
+type WebhookHandler struct {
+	repo WebhookRepository
+}
+
+func NewWebhookHandler(repo WebhookRepository) *WebhookHandler {
+	return &WebhookHandler{repo: repo}
+}
+
+func (h *WebhookHandler) webhooks(c echo.Context) WebhookRepository {
+	return h.repo.WithContext(c.Request().Context())
+}
+
+// apply copies a validated request onto hook. Webhooks are active unless the
+// request says otherwise.
+func (request WebhookRequest) apply(hook *Webhook) {
+	hook.URL = request.URL
+	hook.Secret = request.Secret
+	hook.Events = request.Events
+	hook.Active = request.Active == nil || *request.Active
+}
+
+// @Summary List webhooks
+// @Tags webhooks
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} SuccessResponse{data=[]Webhook}
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks [get]
+func (h *WebhookHandler) List(c echo.Context) error {
+	res, err := h.webhooks(c).FindAll()
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, res, nil)
+}
+
+// Create registers a webhook. Its secret signs every delivery and is never
+// returned by the API.
+// @Summary Register a webhook
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param webhook body WebhookRequest true "Webhook"
+// @Success 201 {object} SuccessResponse{data=Webhook}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks [post]
+func (h *WebhookHandler) Create(c echo.Context) error {
+	var request WebhookRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	var hook Webhook
+	request.apply(&hook)
+	if err := h.webhooks(c).Create(&hook); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusCreated, hook, nil)
+}
+
+// @Summary Get a webhook
+// @Tags webhooks
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} SuccessResponse{data=Webhook}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/{id} [get]
+func (h *WebhookHandler) Get(c echo.Context) error {
+	hook, err := h.webhooks(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "webhook not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, hook, nil)
+}
+
+// @Summary Replace a webhook
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Param webhook body WebhookRequest true "Webhook"
+// @Success 200 {object} SuccessResponse{data=Webhook}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 422 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/{id} [put]
+func (h *WebhookHandler) Replace(c echo.Context) error {
+	var request WebhookRequest
+	if err := c.Bind(&request); err != nil {
+		return respondError(c, http.StatusBadRequest, "invalid request body")
+	}
+	if err := c.Validate(&request); err != nil {
+		return err
+	}
+	hook, err := h.webhooks(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "webhook not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	request.apply(hook)
+	if err := h.webhooks(c).Replace(hook); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, hook, nil)
+}
+
+// Delete removes a webhook along with its queued and past deliveries.
+// @Summary Delete a webhook
+// @Tags webhooks
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} SuccessResponse{data=Webhook}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/{id} [delete]
+func (h *WebhookHandler) Delete(c echo.Context) error {
+	hook, err := h.webhooks(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "webhook not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	if err := h.webhooks(c).Delete(hook); err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, hook, nil)
+}
+
+// Deliveries lists a webhook's most recent deliveries, newest first.
+// Dead-lettered ones have failed_at set.
+// @Summary List a webhook's deliveries
+// @Tags webhooks
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} SuccessResponse{data=[]WebhookDelivery}
+// @Failure 400 {object} ErrorResponse
+// @Failure 401 {object} ErrorResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Router /webhooks/{id}/deliveries [get]
+func (h *WebhookHandler) Deliveries(c echo.Context) error {
+	hook, err := h.webhooks(c).FindByID(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return respondError(c, http.StatusNotFound, "webhook not found")
+		}
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	res, err := h.webhooks(c).FindDeliveries(hook.ID, webhookDeliveriesShown)
+	if err != nil {
+		return respondError(c, http.StatusInternalServerError, err.Error())
+	}
+	return respondOK(c, http.StatusOK, res, nil)
+}
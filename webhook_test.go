@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	const want = "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got := signWebhook("key", []byte("The quick brown fox jumps over the lazy dog")); got != want {
+		t.Errorf("signWebhook() = %s, want %s", got, want)
+	}
+}
+
+func TestEventTypesRoundTrip(t *testing.T) {
+	types := EventTypes{UserCreated, UserDeleted}
+	value, err := types.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []interface{}{value, []byte(value.(string))} {
+		var got EventTypes
+		if err := got.Scan(src); err != nil || !reflect.DeepEqual(got, types) {
+			t.Errorf("Scan(%T) = %v, %v; want %v", src, got, err, types)
+		}
+	}
+	got := EventTypes{UserCreated}
+	if err := got.Scan(nil); err != nil || got != nil {
+		t.Errorf("Scan(nil) = %v, %v; want nil", got, err)
+	}
+	if err := got.Scan(42); err == nil {
+		t.Error("Scan(42) succeeded")
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	status := http.StatusNoContent
+	var received *http.Request
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	delivery := &WebhookDelivery{
+		ID:         9,
+		Webhook:    Webhook{URL: receiver.URL, Secret: "0123456789abcdef"},
+		EventType:  UserCreated,
+		UserID:     7,
+		OccurredAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := postWebhook(context.Background(), receiver.Client(), delivery); err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != UserCreated || event.UserID != 7 || !event.OccurredAt.Equal(delivery.OccurredAt) {
+		t.Errorf("receiver got %+v", event)
+	}
+	for header, want := range map[string]string{
+		"X-Webhook-Event":     string(UserCreated),
+		"X-Webhook-Delivery":  "9",
+		"X-Webhook-Signature": "sha256=" + signWebhook(delivery.Webhook.Secret, body),
+	} {
+		if got := received.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	status = http.StatusBadGateway
+	if err := postWebhook(context.Background(), receiver.Client(), delivery); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("postWebhook() to a failing receiver = %v, want its status", err)
+	}
+}